@@ -13,11 +13,13 @@ import (
 
 	"github.com/absmach/mgate"
 	"github.com/absmach/mgate/examples/simple"
+	"github.com/absmach/mgate/pkg/admin"
 	"github.com/absmach/mgate/pkg/coap"
 	"github.com/absmach/mgate/pkg/http"
 	"github.com/absmach/mgate/pkg/mqtt"
 	"github.com/absmach/mgate/pkg/mqtt/websocket"
 	"github.com/absmach/mgate/pkg/session"
+	"github.com/absmach/mgate/pkg/tracing"
 	"github.com/caarlos0/env/v11"
 	"github.com/joho/godotenv"
 	"golang.org/x/sync/errgroup"
@@ -38,6 +40,10 @@ const (
 
 	coapWithoutDTLS = "MGATE_COAP_WITHOUT_DTLS_"
 	coapWithDTLS    = "MGATE_COAP_WITH_DTLS_"
+
+	adminAPI = "MGATE_ADMIN_"
+
+	tracingPrefix = "MGATE_TRACING_"
 )
 
 func main() {
@@ -59,11 +65,44 @@ func main() {
 		panic(err)
 	}
 
+	// mGate tracing Configuration
+	tracingConfig, err := tracing.NewConfig(env.Options{Prefix: tracingPrefix})
+	if err != nil {
+		panic(err)
+	}
+
+	// Exporter of the traces of the connections and the messages proxied by all the mGate servers
+	shutdownTracing, err := tracing.Init(ctx, tracingConfig)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error(fmt.Sprintf("Failed to flush traces: %s", err))
+		}
+	}()
+
+	// Registry of the sessions open in all the mGate servers
+	registry := session.NewRegistry()
+
+	// mGate admin API Configuration
+	adminConfig, err := admin.NewConfig(env.Options{Prefix: adminAPI})
+	if err != nil {
+		panic(err)
+	}
+
+	// mGate admin API server for listing and disconnecting sessions
+	adminServer := admin.New(adminConfig, registry, logger)
+	g.Go(func() error {
+		return adminServer.Listen(ctx)
+	})
+
 	// mGate server Configuration for MQTT without TLS
 	mqttConfig, err := mgate.NewConfig(env.Options{Prefix: mqttWithoutTLS})
 	if err != nil {
 		panic(err)
 	}
+	mqttConfig.Registry = registry
 
 	// mGate server for MQTT without TLS
 	mqttProxy := mqtt.New(mqttConfig, handler, beforeHandler, afterHandler, logger)
@@ -76,6 +115,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	mqttTLSConfig.Registry = registry
 
 	// mGate server for MQTT with TLS
 	mqttTLSProxy := mqtt.New(mqttTLSConfig, handler, beforeHandler, afterHandler, logger)
@@ -88,6 +128,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	mqttMTLSConfig.Registry = registry
 
 	// mGate server for MQTT with mTLS
 	mqttMTlsProxy := mqtt.New(mqttMTLSConfig, handler, beforeHandler, afterHandler, logger)
@@ -100,6 +141,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	wsConfig.Registry = registry
 
 	// mGate server for MQTT over Websocket without TLS
 	wsProxy := websocket.New(wsConfig, handler, beforeHandler, afterHandler, logger)
@@ -112,6 +154,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	wsTLSConfig.Registry = registry
 
 	// mGate server for MQTT over Websocket with TLS
 	wsTLSProxy := websocket.New(wsTLSConfig, handler, beforeHandler, afterHandler, logger)
@@ -124,6 +167,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	wsMTLSConfig.Registry = registry
 
 	// mGate server for MQTT over Websocket with mTLS
 	wsMTLSProxy := websocket.New(wsMTLSConfig, handler, beforeHandler, afterHandler, logger)
@@ -136,6 +180,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	httpConfig.Registry = registry
 
 	// mGate server for HTTP without TLS
 	httpProxy, err := http.NewProxy(httpConfig, handler, logger, []string{}, []string{})
@@ -151,6 +196,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	httpTLSConfig.Registry = registry
 
 	// mGate server for HTTP with TLS
 	httpTLSProxy, err := http.NewProxy(httpTLSConfig, handler, logger, []string{}, []string{})
@@ -166,6 +212,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	httpMTLSConfig.Registry = registry
 
 	// mGate server for HTTP with mTLS
 	httpMTLSProxy, err := http.NewProxy(httpMTLSConfig, handler, logger, []string{}, []string{})
@@ -181,6 +228,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	coapConfig.Registry = registry
 
 	// mGate server for CoAP without DTLS
 	coapProxy := coap.NewProxy(coapConfig, handler, logger)
@@ -193,6 +241,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	coapDTLSConfig.Registry = registry
 
 	// mGate server for CoAP with DTLS
 	coapDTLSProxy := coap.NewProxy(coapDTLSConfig, handler, logger)
@@ -213,7 +262,7 @@ func main() {
 
 func StopSignalHandler(ctx context.Context, cancel context.CancelFunc, logger *slog.Logger) error {
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGABRT)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 	select {
 	case <-c:
 		cancel()
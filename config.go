@@ -5,22 +5,54 @@ package mgate
 
 import (
 	"crypto/tls"
+	"fmt"
+	"time"
 
+	"github.com/absmach/mgate/pkg/connlimit"
+	"github.com/absmach/mgate/pkg/proxyproto"
+	"github.com/absmach/mgate/pkg/ratelimit"
+	"github.com/absmach/mgate/pkg/session"
 	mptls "github.com/absmach/mgate/pkg/tls"
+	"github.com/absmach/mgate/pkg/upstream"
 	"github.com/caarlos0/env/v11"
 	"github.com/pion/dtls/v3"
 )
 
+const upstreamTLSPrefix = "UPSTREAM_TLS_"
+
+var errShutdownTimeout = "invalid shutdown timeout %s"
+
 type Config struct {
-	Host           string `env:"HOST"                     envDefault:""`
-	Port           string `env:"PORT,required"            envDefault:""`
-	PathPrefix     string `env:"PATH_PREFIX"              envDefault:""`
-	TargetHost     string `env:"TARGET_HOST,required"     envDefault:""`
-	TargetPort     string `env:"TARGET_PORT,required"     envDefault:""`
-	TargetProtocol string `env:"TARGET_PROTOCOL,required" envDefault:""`
-	TargetPath     string `env:"TARGET_PATH"              envDefault:""`
-	TLSConfig      *tls.Config
-	DTLSConfig     *dtls.Config
+	Host           string               `env:"HOST"                     envDefault:""`
+	Port           string               `env:"PORT,required"            envDefault:""`
+	PathPrefix     string               `env:"PATH_PREFIX"              envDefault:""`
+	TargetHost     string               `env:"TARGET_HOST,required"     envDefault:""`
+	TargetPort     string               `env:"TARGET_PORT,required"     envDefault:""`
+	TargetProtocol string               `env:"TARGET_PROTOCOL,required" envDefault:""`
+	TargetPath     string               `env:"TARGET_PATH"              envDefault:""`
+	DenialPolicy   session.DenialPolicy `env:"DOWNSTREAM_DENIAL_POLICY" envDefault:"disconnect"`
+	LocalSubCheck  bool                 `env:"LOCAL_SUBSCRIPTION_CHECK" envDefault:"false"`
+	ConnectTimeout time.Duration        `env:"CONNECT_TIMEOUT"          envDefault:"10s"`
+	IdleTimeout    time.Duration        `env:"BROKER_IDLE_TIMEOUT"      envDefault:"0s"`
+	MaxPacketSize  int                  `env:"MAX_PACKET_SIZE"          envDefault:"0"`
+	MaxTopicLength int                  `env:"MAX_TOPIC_LENGTH"         envDefault:"0"`
+	MaxSubTopics   int                  `env:"MAX_SUBSCRIBE_TOPICS"     envDefault:"0"`
+	RateLimit      ratelimit.Config     `envPrefix:"RATE_LIMIT_"`
+	ConnLimits     connlimit.Config     `envPrefix:"CONN_"`
+	Upstream       upstream.Config      `envPrefix:"UPSTREAM_"`
+	ProxyProtocol  proxyproto.Config    `envPrefix:"PROXY_PROTOCOL_"`
+	// ShutdownTimeout is the grace period the open sessions and requests are drained for on shutdown.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TLSConfig       *tls.Config
+	DTLSConfig      *dtls.Config
+	// Certificates are used by TLSConfig and DTLSConfig, and they are reloaded
+	// by Certificates.Watch. They are nil if TLS is not enabled.
+	Certificates *mptls.Certificates
+	// UpstreamTLSConfig and UpstreamDTLSConfig are used for the connections to the upstream
+	// server. They are nil if upstream TLS is not enabled.
+	UpstreamTLSConfig  *tls.Config
+	UpstreamDTLSConfig *dtls.Config
+	Registry           *session.Registry
 }
 
 func NewConfig(opts env.Options) (Config, error) {
@@ -28,6 +60,13 @@ func NewConfig(opts env.Options) (Config, error) {
 	if err := env.ParseWithOptions(&c, opts); err != nil {
 		return Config{}, err
 	}
+	if err := c.Upstream.Validate(); err != nil {
+		return Config{}, err
+	}
+	// Zero would cancel the shutdown before the sessions are drained.
+	if c.ShutdownTimeout <= 0 {
+		return Config{}, fmt.Errorf(errShutdownTimeout, c.ShutdownTimeout)
+	}
 
 	cfg, err := mptls.NewConfig(opts)
 	if err != nil {
@@ -41,5 +80,21 @@ func NewConfig(opts env.Options) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	c.Certificates = cfg.Certificates()
+
+	upstreamOpts := opts
+	upstreamOpts.Prefix += upstreamTLSPrefix
+	upstreamCfg, err := mptls.NewClientConfig(upstreamOpts)
+	if err != nil {
+		return Config{}, err
+	}
+	c.UpstreamTLSConfig, err = mptls.LoadClientTLSConfig(&upstreamCfg, &tls.Config{})
+	if err != nil {
+		return Config{}, err
+	}
+	c.UpstreamDTLSConfig, err = mptls.LoadClientTLSConfig(&upstreamCfg, &dtls.Config{})
+	if err != nil {
+		return Config{}, err
+	}
 	return c, nil
 }
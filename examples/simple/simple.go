@@ -13,7 +13,10 @@ import (
 
 var errSessionMissing = errors.New("session is missing")
 
-var _ session.Handler = (*Handler)(nil)
+var (
+	_ session.Handler         = (*Handler)(nil)
+	_ session.DeliveryHandler = (*Handler)(nil)
+)
 
 // Handler implements mqtt.Handler interface.
 type Handler struct {
@@ -62,11 +65,25 @@ func (h *Handler) Unsubscribe(ctx context.Context, topics *[]string) error {
 	return h.logAction(ctx, "Unsubscribe", topics, nil)
 }
 
+// Delivered - after QoS 1 or QoS 2 message is acknowledged.
+func (h *Handler) Delivered(ctx context.Context, d session.Delivery) error {
+	return h.logAction(ctx, "Delivered", &[]string{d.Topic}, nil)
+}
+
 // Disconnect on connection lost.
 func (h *Handler) Disconnect(ctx context.Context) error {
+	if cause, ok := session.CauseFromContext(ctx); ok && isTimeout(cause) {
+		h.logger.Warn("Session timed out", slog.Any("cause", cause))
+	}
 	return h.logAction(ctx, "Disconnect", nil, nil)
 }
 
+func isTimeout(err error) bool {
+	return errors.Is(err, session.ErrConnectTimeout) ||
+		errors.Is(err, session.ErrKeepAliveTimeout) ||
+		errors.Is(err, session.ErrIdleTimeout)
+}
+
 func (h *Handler) logAction(ctx context.Context, action string, topics *[]string, payload *[]byte) error {
 	s, ok := session.FromContext(ctx)
 	args := []interface{}{
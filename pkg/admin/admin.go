@@ -0,0 +1,207 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package admin provides HTTP API for the management of the sessions open in mGate,
+// and the metrics endpoint.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/session"
+	"github.com/caarlos0/env/v11"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	contentType  = "application/json"
+	bearerPrefix = "Bearer "
+)
+
+var (
+	errUnauthorized = errors.New("missing or invalid admin token")
+	errMissingTopic = errors.New("missing topic")
+	errUnprotected  = errors.New("admin token is required unless the admin API listens on the loopback interface")
+)
+
+// Config is the admin API server configuration.
+type Config struct {
+	Host string `env:"HOST"  envDefault:"localhost"`
+	Port string `env:"PORT"  envDefault:"8081"`
+	// Token is a bearer token required by all the endpoints. API is not protected if it's empty,
+	// which is allowed only if the API listens on the loopback interface.
+	Token string `env:"TOKEN" envDefault:""`
+}
+
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Server serves admin API:
+//
+//	GET    /sessions              lists open sessions
+//	GET    /sessions/{id}         returns the session
+//	DELETE /sessions/{id}         forcibly disconnects the session
+//	POST   /clients/{id}/publish  publishes the message to the MQTT client with the given client ID
+//	GET    /metrics               returns the metrics of the proxies in the Prometheus format
+type Server struct {
+	config   Config
+	registry *session.Registry
+	logger   *slog.Logger
+	mux      *http.ServeMux
+}
+
+// New returns a new admin API server.
+func New(config Config, registry *session.Registry, logger *slog.Logger) *Server {
+	s := &Server{
+		config:   config,
+		registry: registry,
+		logger:   logger,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /sessions", s.listSessions)
+	s.mux.HandleFunc("GET /sessions/{id}", s.viewSession)
+	s.mux.HandleFunc("DELETE /sessions/{id}", s.disconnectSession)
+	s.mux.HandleFunc("POST /clients/{id}/publish", s.publish)
+	s.mux.Handle("GET /metrics", metrics.Handler())
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		encodeError(w, http.StatusUnauthorized, errUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Listen of the server, this will block.
+func (s *Server) Listen(ctx context.Context) error {
+	if s.config.Token == "" {
+		if !loopback(s.config.Host) {
+			return errUnprotected
+		}
+		s.logger.Warn("Admin API is not protected, any local user can list and disconnect sessions; set the admin token to protect it")
+	}
+	listenAddress := net.JoinHostPort(s.config.Host, s.config.Port)
+	l, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	server := http.Server{Handler: s}
+	s.logger.Info(fmt.Sprintf("Admin API server started at %s", listenAddress))
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return server.Serve(l)
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		return server.Close()
+	})
+	if err := g.Wait(); err != nil {
+		s.logger.Info(fmt.Sprintf("Admin API server at %s exiting with errors", listenAddress), slog.String("error", err.Error()))
+	} else {
+		s.logger.Info(fmt.Sprintf("Admin API server at %s exiting...", listenAddress))
+	}
+	return nil
+}
+
+// loopback reports whether the host is resolved only to the loopback interface.
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, _ *http.Request) {
+	encode(w, http.StatusOK, s.registry.List())
+}
+
+func (s *Server) viewSession(w http.ResponseWriter, r *http.Request) {
+	info, err := s.registry.Get(r.PathValue("id"))
+	if err != nil {
+		encodeError(w, http.StatusNotFound, err)
+		return
+	}
+	encode(w, http.StatusOK, info)
+}
+
+func (s *Server) disconnectSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.registry.Disconnect(id); err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			encodeError(w, http.StatusNotFound, err)
+			return
+		}
+		// The session is closed even if the client could not be notified.
+		s.logger.Warn("Failed to disconnect session gracefully", slog.String("id", id), slog.Any("error", err))
+	}
+	s.logger.Info("Session disconnected by administrator", slog.String("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
+	var pub session.Publication
+	if err := json.NewDecoder(r.Body).Decode(&pub); err != nil {
+		encodeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if pub.Topic == "" {
+		encodeError(w, http.StatusBadRequest, errMissingTopic)
+		return
+	}
+	clientID := r.PathValue("id")
+	if err := s.registry.Publish(clientID, pub); err != nil {
+		switch {
+		case errors.Is(err, session.ErrSessionNotFound):
+			encodeError(w, http.StatusNotFound, err)
+		case errors.Is(err, session.ErrNotConnected), errors.Is(err, session.ErrPublishNotSupported):
+			encodeError(w, http.StatusConflict, err)
+		default:
+			encodeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.logger.Info("Message published by administrator", slog.String("client_id", clientID), slog.String("topic", pub.Topic))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.config.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) == 1
+}
+
+func encode(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func encodeError(w http.ResponseWriter, status int, err error) {
+	encode(w, status, struct {
+		Error string `json:"message"`
+	}{
+		Error: err.Error(),
+	})
+}
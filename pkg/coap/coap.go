@@ -4,7 +4,11 @@
 package coap
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -15,26 +19,42 @@ import (
 	"time"
 
 	"github.com/absmach/mgate"
+	"github.com/absmach/mgate/pkg/connlimit"
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/ratelimit"
 	"github.com/absmach/mgate/pkg/session"
 	mptls "github.com/absmach/mgate/pkg/tls"
+	"github.com/absmach/mgate/pkg/tracing"
+	"github.com/absmach/mgate/pkg/upstream"
 	"github.com/pion/dtls/v3"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/message/pool"
 	"github.com/plgd-dev/go-coap/v3/udp/coder"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	bufferSize   uint64 = 1280
+	bufferSize          = 1280
+	dialTimeout         = 10 * time.Second
+	headerSize          = 4
+	maxTokenSize        = 8
 	startObserve uint32 = 0
 	authQuery           = "auth"
 )
 
 type Conn struct {
 	clientAddr *net.UDPAddr
-	serverConn *net.UDPConn
+	serverConn net.Conn
 	started    atomic.Bool
+	entry      *session.Entry
+	release    func()
+	// ready is closed once the server is dialed. The server connection
+	// and the entry are set only if the dial succeeded, and err otherwise.
+	ready chan struct{}
+	err   error
 }
 
 type Proxy struct {
@@ -43,19 +63,34 @@ type Proxy struct {
 	logger  *slog.Logger
 	connMap map[string]*Conn
 	mutex   sync.Mutex
+	limiter *ratelimit.Limiter
+	conns   *connlimit.Limiter
+	pool    *upstream.Pool
+	group   *session.Group
+	metrics *metrics.Recorder
 }
 
 func NewProxy(config mgate.Config, handler session.Handler, logger *slog.Logger) *Proxy {
+	protocol := session.CoAP
+	if config.DTLSConfig != nil {
+		protocol = session.CoAPDTLS
+	}
+	rec := metrics.NewRecorder(net.JoinHostPort(config.Host, config.Port), string(protocol))
 	return &Proxy{
 		config:  config,
-		session: handler,
+		session: session.InstrumentHandler(handler, rec),
 		logger:  logger,
 		connMap: make(map[string]*Conn),
+		limiter: ratelimit.New(config.RateLimit),
+		conns:   connlimit.New(config.ConnLimits, logger),
+		pool:    upstream.New(config.Upstream, net.JoinHostPort(config.TargetHost, config.TargetPort), logger),
+		group:   session.NewGroup(),
+		metrics: rec,
 	}
 }
 
 func (p *Proxy) proxyUDP(ctx context.Context, l *net.UDPConn) {
-	buffer := make([]byte, bufferSize)
+	buffer := make([]byte, p.bufferSize())
 	for {
 		select {
 		case <-ctx.Done():
@@ -66,30 +101,62 @@ func (p *Proxy) proxyUDP(ctx context.Context, l *net.UDPConn) {
 				p.logger.Error("failed to read from UDP", slog.String("error", err.Error()))
 				return
 			}
-			conn, err := p.newConn(clientAddr)
+			// Messages have no connection, so each one starts a new trace.
+			//nolint:contextcheck // messages are not canceled with the listener
+			mctx, span := tracing.StartMessage(context.Background(), messageType(buffer[:n]), nil, trace.WithAttributes(
+				tracing.ProtocolKey.String(string(session.CoAP)),
+				tracing.DirectionKey.String(metrics.Up),
+				semconv.ClientAddress(clientAddr.String())))
+			conn, err := p.newConn(mctx, clientAddr)
 			if err != nil {
+				tracing.End(span, err)
 				p.logger.Error("failed to create new connection", slog.String("error", err.Error()))
 				continue
 			}
-			//nolint:contextcheck // upUDP does not need context
-			p.upUDP(conn, buffer[:n], l)
+			select {
+			case <-conn.ready:
+				tracing.End(span, p.handleUDP(mctx, conn, buffer[:n], l))
+			default:
+				// The server is being dialed, so the message is handled once it's done
+				// without blocking the messages of the other clients.
+				msg := bytes.Clone(buffer[:n])
+				go func() {
+					<-conn.ready
+					tracing.End(span, p.handleUDP(mctx, conn, msg, l))
+				}()
+			}
 		}
 	}
 }
 
 func (p *Proxy) Listen(ctx context.Context) error {
+	if err := p.config.Upstream.ValidateCheck("udp"); err != nil {
+		return err
+	}
 	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(p.config.Host, p.config.Port))
 	if err != nil {
 		p.logger.Error("failed to resolve UDP address", slog.String("error", err.Error()))
 		return err
 	}
+	p.metrics.Connections(p.conns.Stats)
 	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		p.config.Certificates.Watch(ctx, p.logger)
+		return nil
+	})
+	g.Go(func() error {
+		p.pool.Run(ctx, p.dial)
+		return nil
+	})
 	switch {
 	case p.config.DTLSConfig != nil:
-		l, err := dtls.Listen("udp", addr, p.config.DTLSConfig)
+		dl, err := dtls.Listen("udp", addr, p.config.DTLSConfig)
 		if err != nil {
 			return err
 		}
+		// DTLS handshake is done on the first read, so the connections
+		// over the limits are closed before the handshake.
+		l := connlimit.NewListener(dl, p.conns)
 		defer l.Close()
 
 		g.Go(func() error {
@@ -99,7 +166,7 @@ func (p *Proxy) Listen(ctx context.Context) error {
 
 		g.Go(func() error {
 			<-ctx.Done()
-			return l.Close()
+			return errors.Join(l.Close(), p.shutdown())
 		})
 	default:
 		l, err := net.ListenUDP("udp", addr)
@@ -115,7 +182,7 @@ func (p *Proxy) Listen(ctx context.Context) error {
 
 		g.Go(func() error {
 			<-ctx.Done()
-			return l.Close()
+			return errors.Join(l.Close(), p.shutdown())
 		})
 	}
 
@@ -130,49 +197,114 @@ func (p *Proxy) Listen(ctx context.Context) error {
 	return nil
 }
 
-func (p *Proxy) newConn(clientAddr *net.UDPAddr) (*Conn, error) {
+// shutdown closes the client connections, and waits for the DTLS sessions
+// to finish for up to the shutdown timeout.
+func (p *Proxy) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ShutdownTimeout)
+	defer cancel()
+	p.mutex.Lock()
+	conns := make([]*Conn, 0, len(p.connMap))
+	for _, conn := range p.connMap {
+		conns = append(conns, conn)
+	}
+	p.mutex.Unlock()
+	for _, conn := range conns {
+		p.closeConn(conn)
+	}
+	p.logger.Info(fmt.Sprintf("COAP proxy server draining %d sessions", len(conns)+p.group.Len()))
+	return p.group.Shutdown(ctx)
+}
+
+// newConn returns the connection of the client, or the new one if the client has none.
+// The server of the new connection is dialed in the background, and the connection is
+// ready once the dial is done, so the clients don't wait for the others to be dialed.
+func (p *Proxy) newConn(ctx context.Context, clientAddr *net.UDPAddr) (*Conn, error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	conn, ok := p.connMap[clientAddr.String()]
-	if !ok {
-		conn = &Conn{clientAddr: clientAddr}
-		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(p.config.TargetHost, p.config.TargetPort))
-		if err != nil {
-			return nil, err
-		}
-		t, err := net.DialUDP("udp", nil, addr)
-		if err != nil {
-			return nil, err
-		}
-		conn.serverConn = t
-		p.connMap[clientAddr.String()] = conn
+	if ok {
+		return conn, nil
+	}
+	release, err := p.conns.Acquire(clientAddr)
+	if err != nil {
+		return nil, err
 	}
+	conn = &Conn{clientAddr: clientAddr, release: release, ready: make(chan struct{})}
+	p.connMap[clientAddr.String()] = conn
+	//nolint:contextcheck // the dial is bound by its own timeout
+	go p.connect(context.WithoutCancel(ctx), conn)
 	return conn, nil
 }
 
-func (p *Proxy) upUDP(conn *Conn, buffer []byte, l *net.UDPConn) {
-	if msg, err := p.handleCoAPMessage(context.Background(), buffer); err != nil {
-		data := p.encodeErrorResponse(context.Background(), msg, err)
+// connect dials the server of the client connection, and marks the connection ready.
+func (p *Proxy) connect(ctx context.Context, conn *Conn) {
+	defer close(conn.ready)
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	t, err := p.pool.Dial(ctx, "", p.dial)
+	if err != nil {
+		p.metrics.DialFailed()
+		conn.err = err
+		p.closeConn(conn)
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// The connection is closed while dialing, such as on shutdown.
+	if p.connMap[conn.clientAddr.String()] != conn {
+		conn.err = net.ErrClosed
+		t.Close()
+		return
+	}
+	conn.serverConn = t
+	conn.entry = p.config.Registry.Register(session.CoAP, conn.clientAddr)
+	conn.entry.OnDisconnect(func() error {
+		p.closeConn(conn)
+		return nil
+	})
+}
+
+// handleUDP handles the client message once the connection is ready.
+func (p *Proxy) handleUDP(ctx context.Context, conn *Conn, buffer []byte, l *net.UDPConn) error {
+	if conn.err != nil {
+		return conn.err
+	}
+	return p.upUDP(ctx, conn, buffer, l)
+}
+
+// upUDP authorizes the client message, and forwards it to the server.
+func (p *Proxy) upUDP(ctx context.Context, conn *Conn, buffer []byte, l *net.UDPConn) error {
+	conn.entry.Received(1, len(buffer))
+	base := session.Session{RemoteAddr: conn.clientAddr, LocalAddr: l.LocalAddr(), Protocol: session.CoAP}
+	if msg, err := p.handleCoAPMessage(ctx, buffer, base); err != nil {
+		data := p.encodeErrorResponse(ctx, msg, err)
 		if len(data) > 0 {
 			if _, werr := l.WriteToUDP(data, conn.clientAddr); werr != nil {
 				p.logger.Error("failed to send error response", slog.String("err", werr.Error()))
 			}
 		}
-		return
+		if errors.Is(err, ratelimit.ErrLimitExceeded) {
+			p.closeConn(conn)
+		}
+		return err
 	}
 
-	if _, err := conn.serverConn.Write(buffer); err != nil {
-		return
+	if err := write(ctx, conn.serverConn, buffer); err != nil {
+		return err
 	}
+	p.metrics.Packet(metrics.Up, messageType(buffer), len(buffer))
 
 	// Start the downstream reader once the first upstream write succeeds.
 	if conn.started.CompareAndSwap(false, true) {
+		//nolint:contextcheck // downstream reader outlives the message
 		go p.downUDP(context.Background(), l, conn)
 	}
+	return nil
 }
 
 func (p *Proxy) downUDP(ctx context.Context, l *net.UDPConn, conn *Conn) {
-	buffer := make([]byte, bufferSize)
+	buffer := make([]byte, p.bufferSize())
 	for {
 		select {
 		case <-ctx.Done():
@@ -193,14 +325,24 @@ func (p *Proxy) downUDP(ctx context.Context, l *net.UDPConn, conn *Conn) {
 		if err != nil {
 			return
 		}
+		conn.entry.Sent(1, n)
+		p.metrics.Packet(metrics.Down, messageType(buffer[:n]), n)
 	}
 }
 
 func (p *Proxy) closeConn(conn *Conn) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	delete(p.connMap, conn.clientAddr.String())
-	conn.serverConn.Close()
+	// The connection may already be replaced by a new one for the same client.
+	if p.connMap[conn.clientAddr.String()] == conn {
+		delete(p.connMap, conn.clientAddr.String())
+	}
+	p.config.Registry.Unregister(conn.entry)
+	conn.release()
+	// The server is not set until the dial succeeds.
+	if conn.serverConn != nil {
+		conn.serverConn.Close()
+	}
 }
 
 func (p *Proxy) proxyDTLS(ctx context.Context, l net.Listener) {
@@ -222,28 +364,52 @@ func (p *Proxy) proxyDTLS(ctx context.Context, l net.Listener) {
 
 func (p *Proxy) handleDTLS(ctx context.Context, inbound net.Conn) {
 	defer inbound.Close()
-	outboundAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(p.config.TargetHost, p.config.TargetPort))
+	m, err := p.group.Join()
 	if err != nil {
-		p.logger.Error("cannot resolve remote broker address " + net.JoinHostPort(p.config.TargetHost, p.config.TargetPort) + " due to: " + err.Error())
 		return
 	}
-
-	outbound, err := net.DialUDP("udp", nil, outboundAddr)
+	defer m.Leave()
+	m.OnShutdown(inbound.Close)
+	// The session outlives the listener, so it can be closed gracefully on shutdown.
+	ctx = context.WithoutCancel(ctx)
+	ctx, span := tracing.StartConnection(ctx, string(session.CoAPDTLS), inbound.RemoteAddr())
+	base, err := p.dtlsSession(ctx, inbound)
 	if err != nil {
-		p.logger.Error("cannot connect to remote broker " + outboundAddr.String() + " due to: " + err.Error())
+		tracing.End(span, err)
+		p.metrics.HandshakeFailed(err)
+		p.logger.Error("DTLS handshake failed", slog.String("remote", inbound.RemoteAddr().String()), slog.String("error", err.Error()))
 		return
 	}
+	dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	outbound, err := p.pool.Dial(dctx, "", p.dial)
+	cancel()
+	if err != nil {
+		tracing.End(span, err)
+		p.metrics.DialFailed()
+		p.logger.Error("cannot connect to remote broker due to: " + err.Error())
+		return
+	}
+	defer span.End()
 	defer outbound.Close()
 
+	entry := p.config.Registry.Register(session.CoAPDTLS, inbound.RemoteAddr())
+	defer p.config.Registry.Unregister(entry)
+	entry.OnDisconnect(func() error {
+		return errors.Join(inbound.Close(), outbound.Close())
+	})
+	m.OnShutdown(func() error {
+		return errors.Join(inbound.Close(), outbound.Close())
+	})
+
 	g, gCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		p.dtlsUp(gCtx, outbound, inbound)
+		p.dtlsUp(gCtx, outbound, inbound, entry, base)
 		return nil
 	})
 
 	g.Go(func() error {
-		p.dtlsDown(inbound, outbound)
+		p.dtlsDown(inbound, outbound, entry)
 		return nil
 	})
 
@@ -252,31 +418,50 @@ func (p *Proxy) handleDTLS(ctx context.Context, inbound net.Conn) {
 	}
 }
 
-func (p *Proxy) dtlsUp(ctx context.Context, outbound *net.UDPConn, inbound net.Conn) {
-	buffer := make([]byte, bufferSize)
+func (p *Proxy) dtlsUp(ctx context.Context, outbound net.Conn, inbound net.Conn, entry *session.Entry, base session.Session) {
+	buffer := make([]byte, p.bufferSize())
 	for {
 		n, err := inbound.Read(buffer)
 		if err != nil {
 			return
 		}
-		if msg, err := p.handleCoAPMessage(ctx, buffer[:n]); err != nil {
-			data := p.encodeErrorResponse(ctx, msg, err)
-			if len(data) > 0 {
-				if _, werr := inbound.Write(data); werr != nil {
-					p.logger.Error("failed to send error response", slog.String("err", werr.Error()))
-				}
-			}
+		entry.Received(1, n)
+		// Each message has its own trace linked to the connection.
+		mctx, span := tracing.StartMessage(ctx, messageType(buffer[:n]), nil, trace.WithAttributes(
+			tracing.ProtocolKey.String(string(session.CoAPDTLS)),
+			tracing.DirectionKey.String(metrics.Up)))
+		err = p.upDTLS(mctx, outbound, inbound, buffer[:n], base)
+		tracing.End(span, err)
+		switch {
+		case errors.Is(err, ratelimit.ErrDropped):
+			continue
+		case err != nil:
 			return
 		}
+	}
+}
 
-		if _, err = outbound.Write(buffer[:n]); err != nil {
-			return
+// upDTLS authorizes the client message, and forwards it to the server.
+func (p *Proxy) upDTLS(ctx context.Context, outbound, inbound net.Conn, buffer []byte, base session.Session) error {
+	if msg, err := p.handleCoAPMessage(ctx, buffer, base); err != nil {
+		data := p.encodeErrorResponse(ctx, msg, err)
+		if len(data) > 0 {
+			if _, werr := inbound.Write(data); werr != nil {
+				p.logger.Error("failed to send error response", slog.String("err", werr.Error()))
+			}
 		}
+		return err
+	}
+
+	if err := write(ctx, outbound, buffer); err != nil {
+		return err
 	}
+	p.metrics.Packet(metrics.Up, messageType(buffer), len(buffer))
+	return nil
 }
 
-func (p *Proxy) dtlsDown(inbound net.Conn, outbound *net.UDPConn) {
-	buffer := make([]byte, bufferSize)
+func (p *Proxy) dtlsDown(inbound, outbound net.Conn, entry *session.Entry) {
+	buffer := make([]byte, p.bufferSize())
 	for {
 		err := outbound.SetReadDeadline(time.Now().Add(1 * time.Minute))
 		if err != nil {
@@ -290,12 +475,61 @@ func (p *Proxy) dtlsDown(inbound net.Conn, outbound *net.UDPConn) {
 		if _, err = inbound.Write(buffer[:n]); err != nil {
 			return
 		}
+		entry.Sent(1, n)
+		p.metrics.Packet(metrics.Down, messageType(buffer[:n]), n)
 	}
 }
 
-func (p *Proxy) handleCoAPMessage(ctx context.Context, buffer []byte) (*pool.Message, error) {
+// dtlsSession completes the handshake of the DTLS client connection, and returns
+// the session with the connection metadata.
+func (p *Proxy) dtlsSession(ctx context.Context, conn net.Conn) (session.Session, error) {
+	s := session.Session{
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+		Protocol:   session.CoAPDTLS,
+	}
+	for c := conn; c != nil; {
+		if dc, ok := c.(*dtls.Conn); ok {
+			hctx, span := tracing.Start(ctx, tracing.Handshake)
+			err := dc.HandshakeContext(hctx)
+			tracing.End(span, err)
+			if err != nil {
+				return s, err
+			}
+			state, ok := dc.ConnectionState()
+			if !ok {
+				break
+			}
+			s.TLS = &session.TLS{
+				Version:     session.VersionDTLS12,
+				CipherSuite: uint16(state.CipherSuiteID),
+				ServerName:  p.config.Certificates.ServerName(&state),
+			}
+			if len(state.PeerCertificates) > 0 && p.config.Certificates.RequestsClientCert(&state) {
+				if cert, err := x509.ParseCertificate(state.PeerCertificates[0]); err == nil {
+					s.Cert = *cert
+				}
+			}
+			break
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = u.NetConn()
+	}
+	return s, nil
+}
+
+// handleCoAPMessage authorizes the message in the session created from the base one,
+// which holds the client connection metadata.
+func (p *Proxy) handleCoAPMessage(ctx context.Context, buffer []byte, base session.Session) (*pool.Message, error) {
 	var payload []byte
 	var path string
+	// The oversized message may be truncated to the buffer size, so it's not decoded.
+	if p.config.MaxPacketSize > 0 && len(buffer) > p.config.MaxPacketSize {
+		return decodeHeader(ctx, buffer), NewCOAPProxyError(codes.RequestEntityTooLarge, session.ErrPacketTooLarge)
+	}
 	msg := pool.NewMessage(ctx)
 	_, err := msg.UnmarshalWithDecoder(coder.DefaultCoder, buffer)
 	if err != nil {
@@ -314,8 +548,15 @@ func (p *Proxy) handleCoAPMessage(ctx context.Context, buffer []byte) (*pool.Mes
 	if err != nil {
 		return msg, err
 	}
+	if p.config.MaxTopicLength > 0 && len(path) > p.config.MaxTopicLength {
+		return msg, NewCOAPProxyError(codes.RequestEntityTooLarge, session.ErrTopicTooLong)
+	}
 
-	ctx = session.NewContext(ctx, &session.Session{Password: []byte(authKey)})
+	s := &base
+	s.Password = []byte(authKey)
+	s.RateLimit = p.limiter.Limit()
+	ctx = session.NewContext(ctx, s)
+	ctx = session.NewMessageContext(ctx, newMessage(msg, s.Protocol))
 
 	if msg.Body() != nil {
 		payload, err = io.ReadAll(msg.Body())
@@ -329,6 +570,9 @@ func (p *Proxy) handleCoAPMessage(ctx context.Context, buffer []byte) (*pool.Mes
 		if err := p.session.AuthConnect(ctx); err != nil {
 			return msg, err
 		}
+		if err := p.rateLimit(ctx, s, len(payload)); err != nil {
+			return msg, err
+		}
 		if err := p.session.AuthPublish(ctx, &path, &payload); err != nil {
 			return msg, err
 		}
@@ -354,6 +598,48 @@ func (p *Proxy) handleCoAPMessage(ctx context.Context, buffer []byte) (*pool.Mes
 	return msg, nil
 }
 
+// rateLimit applies the session rate limit to the message. Plain UDP clients share
+// a single reader, so messages are never delayed there and are dropped instead.
+func (p *Proxy) rateLimit(ctx context.Context, s *session.Session, size int) error {
+	key := p.limiter.Key(s.ID, s.Username, s.RemoteAddr.String())
+	var err error
+	switch s.Protocol {
+	case session.CoAP:
+		err = p.limiter.Allow(key, s.RateLimit, size)
+	default:
+		err = p.limiter.Wait(ctx, key, s.RateLimit, size)
+	}
+	if err != nil {
+		return NewCOAPProxyError(codes.TooManyRequests, err)
+	}
+	return nil
+}
+
+// bufferSize returns the size of the buffer the messages are read into. The buffer is
+// larger than the packet size limit, so the messages over the limit can be told apart
+// from the ones truncated to the buffer size.
+func (p *Proxy) bufferSize() int {
+	if p.config.MaxPacketSize >= bufferSize {
+		return p.config.MaxPacketSize + 1
+	}
+	return bufferSize
+}
+
+// decodeHeader returns the message with the type, the message ID and the token decoded
+// from the fixed header of the message, which is enough to respond to it with an error.
+func decodeHeader(ctx context.Context, buffer []byte) *pool.Message {
+	msg := pool.NewMessage(ctx)
+	if len(buffer) < headerSize {
+		return msg
+	}
+	msg.SetType(message.Type(buffer[0] >> 4 & 0x3))
+	msg.SetMessageID(int32(binary.BigEndian.Uint16(buffer[2:headerSize])))
+	if tkl := int(buffer[0] & 0xf); tkl <= maxTokenSize && len(buffer) >= headerSize+tkl {
+		msg.SetToken(buffer[headerSize : headerSize+tkl])
+	}
+	return msg
+}
+
 func (p *Proxy) encodeErrorResponse(ctx context.Context, msg *pool.Message, err error) []byte {
 	resp := pool.NewMessage(ctx)
 	resp.SetToken(msg.Token())
@@ -375,6 +661,46 @@ func (p *Proxy) encodeErrorResponse(ctx context.Context, msg *pool.Message, err
 	return data
 }
 
+// write writes the message to the server in its span.
+func write(ctx context.Context, conn net.Conn, buffer []byte) error {
+	_, span := tracing.Start(ctx, tracing.Write)
+	_, err := conn.Write(buffer)
+	tracing.End(span, err)
+	return err
+}
+
+// dial connects to the upstream server in its span, using DTLS if it is configured.
+func (p *Proxy) dial(ctx context.Context, addr string) (conn net.Conn, err error) {
+	ctx, span := tracing.Start(ctx, tracing.Dial, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.ServerAddress(addr)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	if p.config.UpstreamDTLSConfig == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", addr)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	config := p.config.UpstreamDTLSConfig
+	if config.ServerName == "" {
+		c := *config
+		c.ServerName, _, _ = net.SplitHostPort(addr)
+		config = &c
+	}
+	dc, err := dtls.Dial("udp", raddr, config)
+	if err != nil {
+		return nil, err
+	}
+	// Handshake right away, so the failures are reported to the upstream pool.
+	if err := dc.HandshakeContext(ctx); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
 func parseKey(msg *pool.Message) (string, error) {
 	authKey, err := msg.Options().GetString(message.URIQuery)
 	if err != nil {
@@ -386,3 +712,25 @@ func parseKey(msg *pool.Message) (string, error) {
 	}
 	return vars[1], nil
 }
+
+// messageType returns the code of the raw CoAP message, such as "POST" or "Content",
+// used as the packet type in the metrics.
+func messageType(data []byte) string {
+	if len(data) < 4 {
+		return "unknown"
+	}
+	return codes.Code(data[1]).String()
+}
+
+// newMessage maps CoAP message metadata to the session message.
+// Confirmable messages are acknowledged, so they are reported as QoS 1.
+func newMessage(msg *pool.Message, protocol session.Protocol) *session.Message {
+	m := &session.Message{
+		Protocol: protocol,
+		PacketID: uint16(msg.MessageID()),
+	}
+	if msg.Type() == message.Confirmable {
+		m.QoS = 1
+	}
+	return m
+}
@@ -38,6 +38,10 @@ func (cpe *coapProxyError) StatusCode() codes.Code {
 	return cpe.statusCode
 }
 
+func (cpe *coapProxyError) Unwrap() error {
+	return cpe.err
+}
+
 func NewCOAPProxyError(statusCode codes.Code, err error) COAPProxyError {
 	return &coapProxyError{statusCode: statusCode, err: err}
 }
@@ -0,0 +1,229 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package connlimit limits the number of client connections accepted by the proxies.
+package connlimit
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/absmach/mgate/pkg/ratelimit"
+)
+
+var (
+	// ErrTooManyConnections indicates the total number of connections is at the limit.
+	ErrTooManyConnections = errors.New("too many connections")
+
+	// ErrTooManyConnectionsPerIP indicates the number of connections from the client IP is at the limit.
+	ErrTooManyConnectionsPerIP = errors.New("too many connections from the IP address")
+
+	// ErrConnectionRate indicates the client IP opens new connections too fast.
+	ErrConnectionRate = errors.New("connection rate exceeded for the IP address")
+)
+
+// Config is the connection limits configuration. Zero values mean no limit.
+type Config struct {
+	// Max is the maximum number of concurrent connections.
+	Max int `env:"MAX"         envDefault:"0"`
+	// MaxPerIP is the maximum number of concurrent connections from a single IP address.
+	MaxPerIP int `env:"MAX_PER_IP"  envDefault:"0"`
+	// RatePerIP is the maximum number of new connections per second from a single IP address.
+	RatePerIP float64 `env:"RATE_PER_IP" envDefault:"0"`
+}
+
+// Stats are the connection counters of the limiter.
+type Stats struct {
+	Active   int64  `json:"active"`
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// Limiter keeps track of the open connections and rejects the connections over the limits.
+// It is safe for concurrent use. All the methods are safe to call on nil Limiter,
+// which does not limit anything.
+type Limiter struct {
+	config Config
+	rate   *ratelimit.Limiter
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	active int
+	perIP  map[string]int
+
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// New returns a new connection limiter.
+func New(config Config, logger *slog.Logger) *Limiter {
+	l := &Limiter{
+		config: config,
+		logger: logger,
+		perIP:  make(map[string]int),
+	}
+	if config.RatePerIP > 0 {
+		l.rate = ratelimit.New(ratelimit.Config{
+			Messages: config.RatePerIP,
+			Key:      ratelimit.IP,
+			Action:   ratelimit.Drop,
+		})
+	}
+	return l
+}
+
+// Acquire reserves a connection slot for the client with the given address.
+// The returned function releases the slot, and it is safe to call it more than once.
+func (l *Limiter) Acquire(addr net.Addr) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	ip := host(addr)
+	if err := l.acquire(ip); err != nil {
+		l.rejected.Add(1)
+		l.logger.Warn("Connection rejected", slog.String("remote", addr.String()), slog.Any("error", err))
+		return nil, err
+	}
+	l.accepted.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(ip)
+		})
+	}, nil
+}
+
+// Reservation is a slot of the total connections limit reserved for the connection whose
+// client address is not known yet, such as the one with PROXY protocol header not read yet.
+type Reservation struct {
+	l    *Limiter
+	done atomic.Bool
+}
+
+// Reserve reserves a slot of the total connections limit. The client limits are applied
+// with Reservation.Acquire once the client address is known.
+func (l *Limiter) Reserve() (*Reservation, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.Max > 0 && l.active >= l.config.Max {
+		l.rejected.Add(1)
+		return nil, ErrTooManyConnections
+	}
+	l.active++
+	return &Reservation{l: l}, nil
+}
+
+// Acquire reserves the connection slot for the client with the given address, keeping the
+// reserved slot of the total limit. The returned function releases the slot, and it is safe
+// to call it more than once. The reservation can't be used or canceled once it's acquired.
+func (r *Reservation) Acquire(addr net.Addr) (func(), error) {
+	if r == nil {
+		return func() {}, nil
+	}
+	l := r.l
+	ip := host(addr)
+	l.mu.Lock()
+	err := l.acquireClient(ip)
+	l.mu.Unlock()
+	if err == nil && !r.done.CompareAndSwap(false, true) {
+		l.mu.Lock()
+		l.releaseClient(ip)
+		l.mu.Unlock()
+		err = net.ErrClosed
+	}
+	if err != nil {
+		l.rejected.Add(1)
+		l.logger.Warn("Connection rejected", slog.String("remote", addr.String()), slog.Any("error", err))
+		return nil, err
+	}
+	l.accepted.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(ip)
+		})
+	}, nil
+}
+
+// Cancel releases the reserved slot, unless the reservation is acquired.
+func (r *Reservation) Cancel() {
+	if r == nil || !r.done.CompareAndSwap(false, true) {
+		return
+	}
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	r.l.active--
+}
+
+// Stats returns the connection counters.
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	return Stats{
+		Active:   int64(active),
+		Accepted: l.accepted.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+func (l *Limiter) acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.Max > 0 && l.active >= l.config.Max {
+		return ErrTooManyConnections
+	}
+	if err := l.acquireClient(ip); err != nil {
+		return err
+	}
+	l.active++
+	return nil
+}
+
+// acquireClient applies the limits of the client IP. It must be called with the lock held.
+func (l *Limiter) acquireClient(ip string) error {
+	if l.config.MaxPerIP > 0 && l.perIP[ip] >= l.config.MaxPerIP {
+		return ErrTooManyConnectionsPerIP
+	}
+	// The rate is checked last, so the connections rejected by
+	// the other limits do not count towards the rate.
+	if err := l.rate.Allow(l.rate.Key("", "", ip), l.rate.Limit(), 0); err != nil {
+		return ErrConnectionRate
+	}
+	l.perIP[ip]++
+	return nil
+}
+
+// releaseClient releases the slot of the client IP. It must be called with the lock held.
+func (l *Limiter) releaseClient(ip string) {
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func (l *Limiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.releaseClient(ip)
+}
+
+func host(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package connlimit
+
+import (
+	"log/slog"
+	"net"
+)
+
+type listener struct {
+	net.Listener
+	limiter *Limiter
+}
+
+// NewListener returns a listener that closes the accepted connections over the limits
+// right away. It must wrap the inner listener, so the rejected connections are closed
+// before the TLS handshake.
+func NewListener(inner net.Listener, limiter *Limiter) net.Listener {
+	if limiter == nil {
+		return inner
+	}
+	return &listener{Listener: inner, limiter: limiter}
+}
+
+// Accept waits for and returns the next connection within the limits. The limits
+// of the connection with the slot reserved by the reserving listener are applied
+// to the reservation.
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		acquire := l.limiter.Acquire
+		if r := reservationFromConn(c); r != nil {
+			acquire = r.Acquire
+		}
+		release, err := acquire(c.RemoteAddr())
+		if err != nil {
+			c.Close()
+			continue
+		}
+		return &conn{Conn: c, release: release}, nil
+	}
+}
+
+// conn releases the connection slot when closed.
+type conn struct {
+	net.Conn
+	release func()
+}
+
+func (c *conn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type reservingListener struct {
+	net.Listener
+	limiter *Limiter
+}
+
+// NewReservingListener returns a listener that reserves a slot of the total connections
+// limit for the accepted connections, and closes the ones over the limit right away.
+// The client limits are applied by the listener returned by NewListener wrapping it.
+// It is used in front of PROXY protocol listener, so the connections are limited before
+// their headers are read, while the client limits apply to the address from the header.
+func NewReservingListener(inner net.Listener, limiter *Limiter) net.Listener {
+	if limiter == nil {
+		return inner
+	}
+	return &reservingListener{Listener: inner, limiter: limiter}
+}
+
+// Accept waits for and returns the next connection within the total limit.
+func (l *reservingListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		r, err := l.limiter.Reserve()
+		if err != nil {
+			l.limiter.logger.Warn("Connection rejected", slog.String("remote", c.RemoteAddr().String()), slog.Any("error", err))
+			c.Close()
+			continue
+		}
+		return &reservedConn{Conn: c, reservation: r}, nil
+	}
+}
+
+// reservedConn cancels the reservation when closed, unless it's acquired.
+type reservedConn struct {
+	net.Conn
+	reservation *Reservation
+}
+
+func (c *reservedConn) Close() error {
+	defer c.reservation.Cancel()
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *reservedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// reservationFromConn returns the reservation of the connection, or nil if it has none.
+// Connections wrapping the other ones are unwrapped.
+func reservationFromConn(conn net.Conn) *Reservation {
+	for conn != nil {
+		if c, ok := conn.(*reservedConn); ok {
+			return c.reservation
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = u.NetConn()
+	}
+	return nil
+}
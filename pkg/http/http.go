@@ -8,20 +8,33 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/absmach/mgate"
+	"github.com/absmach/mgate/pkg/connlimit"
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/proxyproto"
+	"github.com/absmach/mgate/pkg/ratelimit"
 	"github.com/absmach/mgate/pkg/session"
 	mptls "github.com/absmach/mgate/pkg/tls"
+	"github.com/absmach/mgate/pkg/tracing"
 	"github.com/absmach/mgate/pkg/transport"
+	"github.com/absmach/mgate/pkg/upstream"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -33,6 +46,7 @@ const (
 	connHeaderVal    = "upgrade"
 	upgradeHeaderKey = "Upgrade"
 	upgradeHeaderVal = "websocket"
+	responseType     = "response"
 )
 
 type Checker interface {
@@ -44,6 +58,16 @@ func isWebSocketRequest(r *http.Request) bool {
 		strings.EqualFold(r.Header.Get(upgradeHeaderKey), upgradeHeaderVal)
 }
 
+// remoteAddr returns the client address of the request, which is the original
+// client address if PROXY protocol is used.
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addr)
+}
+
 func (p Proxy) getUserPass(r *http.Request) (string, string) {
 	username, password, ok := r.BasicAuth()
 	switch {
@@ -67,26 +91,68 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	r.URL.Path = strings.TrimPrefix(r.URL.Path, p.config.PathPrefix)
 
+	// The request continues the trace of the client, if any, and the WebSocket
+	// connection is traced in the span of its upgrade request.
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	if err := p.bypass.Check(r); err == nil {
-		p.target.ServeHTTP(w, r)
+		p.metrics.Packet(metrics.Up, r.Method, int(max(r.ContentLength, 0)))
+		p.forward(w, r, "")
 		return
 	}
 
 	username, password := p.getUserPass(r)
+	proxyHeader, _ := proxyproto.FromContext(r.Context())
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
 	s := &session.Session{
-		Password: []byte(password),
-		Username: username,
+		Password:    []byte(password),
+		Username:    username,
+		RateLimit:   p.limiter.Limit(),
+		ProxyHeader: proxyHeader,
+		RemoteAddr:  remoteAddr(r),
+		LocalAddr:   localAddr,
+		Protocol:    session.HTTP,
+		TLS:         session.NewTLS(r.TLS),
+		Header:      r.Header,
 	}
 
 	if isWebSocketRequest(r) {
+		s.Protocol = session.HTTPWS
 		//nolint:contextcheck // handleWebSocket does not need context
 		p.handleWebSocket(w, r, s)
 		return
 	}
 
-	ctx := session.NewContext(r.Context(), s)
+	if p.config.MaxTopicLength > 0 && len(r.URL.Path) > p.config.MaxTopicLength {
+		encodeError(w, http.StatusRequestURITooLong, session.ErrTopicTooLong)
+		p.logger.Error("Failed to read request", slog.Any("error", session.ErrTopicTooLong))
+		return
+	}
+	if p.config.MaxPacketSize > 0 {
+		// Reject the request by its Content-Length before reading the body, and
+		// limit the body in case the length is unknown or not truthful.
+		if r.ContentLength > int64(p.config.MaxPacketSize) {
+			encodeError(w, http.StatusRequestEntityTooLarge, session.ErrPacketTooLarge)
+			p.logger.Error("Failed to read body", slog.Any("error", session.ErrPacketTooLarge))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(p.config.MaxPacketSize))
+	}
+
+	ctx = session.NewContext(ctx, s)
+	ctx = session.NewMessageContext(ctx, &session.Message{Protocol: session.HTTP})
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			encodeError(w, http.StatusRequestEntityTooLarge, session.ErrPacketTooLarge)
+			p.logger.Error("Failed to read body", slog.Any("error", session.ErrPacketTooLarge))
+			return
+		}
 		encodeError(w, http.StatusBadRequest, err)
 		p.logger.Error("Failed to read body", slog.Any("error", err))
 		return
@@ -105,6 +171,12 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		p.logger.Error("Failed to authorize connect", slog.Any("error", err))
 		return
 	}
+	key := p.limiter.Key(s.ID, s.Username, r.RemoteAddr)
+	if err := p.limiter.Wait(ctx, key, s.RateLimit, len(payload)); err != nil {
+		encodeError(w, http.StatusTooManyRequests, err)
+		p.logger.Warn("Rate limit exceeded", slog.String("key", key), slog.Any("error", err))
+		return
+	}
 	if err := p.session.AuthPublish(ctx, &r.RequestURI, &payload); err != nil {
 		encodeError(w, http.StatusForbidden, err)
 		p.logger.Error("Failed to authorize publish", slog.Any("error", err))
@@ -116,7 +188,100 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p.target.ServeHTTP(w, r)
+	p.metrics.Packet(metrics.Up, r.Method, len(payload))
+	p.forward(w, r, p.pool.Key(s.ID, s.Username))
+}
+
+// forward forwards the request to the upstream target selected from the pool for the client with the given key.
+func (p Proxy) forward(w http.ResponseWriter, r *http.Request, key string) {
+	t, err := p.pool.Acquire(key)
+	if err != nil {
+		encodeError(w, http.StatusBadGateway, err)
+		p.logger.Error("Failed to select upstream target", slog.Any("error", err))
+		return
+	}
+	defer t.Release()
+	// The trace context is forwarded to the target in the request headers.
+	ctx, span := tracing.Start(r.Context(), tracing.Write, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	tracing.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	p.targets[t.Addr()].ServeHTTP(w, r.WithContext(ctx))
+}
+
+// dialTarget connects to the target with the given address, and completes
+// the TLS handshake if the target is served over HTTPS.
+func (p Proxy) dialTarget(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil || p.config.TargetProtocol != "https" {
+		return conn, err
+	}
+	config := p.config.UpstreamTLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// newReverseProxy returns the reverse proxy to the target, which reports the
+// upstream failures to the pool.
+func newReverseProxy(scheme string, t *upstream.Target, transport http.RoundTripper, rec *metrics.Recorder, logger *slog.Logger) *httputil.ReverseProxy {
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme, Host: t.Addr()})
+	rp.Transport = transport
+	rp.ModifyResponse = func(resp *http.Response) error {
+		t.Report(nil)
+		span := trace.SpanFromContext(resp.Request.Context())
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+		resp.Body = &meteredBody{ReadCloser: resp.Body, rec: rec}
+		return nil
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// Requests canceled by the client are not upstream failures.
+		if !errors.Is(err, context.Canceled) {
+			t.Report(err)
+		}
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			rec.DialFailed()
+		}
+		tracing.Fail(trace.SpanFromContext(r.Context()), err)
+		logger.Error("Failed to forward request", slog.String("target", t.Addr()), slog.Any("error", err))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return rp
+}
+
+// meteredBody records the upstream response once its body is forwarded to the client.
+type meteredBody struct {
+	io.ReadCloser
+	rec  *metrics.Recorder
+	n    int
+	once sync.Once
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += n
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	b.once.Do(func() {
+		b.rec.Packet(metrics.Down, responseType, b.n)
+	})
+	return b.ReadCloser.Close()
 }
 
 func checkOrigin(allowedOrigins []string) func(r *http.Request) bool {
@@ -141,17 +306,35 @@ func encodeError(w http.ResponseWriter, defStatusCode int, err error) {
 // Proxy represents HTTP Proxy.
 type Proxy struct {
 	config     mgate.Config
-	target     *httputil.ReverseProxy
+	targets    map[string]*httputil.ReverseProxy
+	pool       *upstream.Pool
 	session    session.Handler
+	wsSession  session.Handler
 	logger     *slog.Logger
 	wsUpgrader websocket.Upgrader
+	wsDialer   *websocket.Dialer
 	bypass     Checker
+	limiter    *ratelimit.Limiter
+	conns      *connlimit.Limiter
+	group      *session.Group
+	metrics    *metrics.Recorder
+	wsMetrics  *metrics.Recorder
 }
 
 func NewProxy(config mgate.Config, handler session.Handler, logger *slog.Logger, allowedOrigins []string, bypassPaths []string) (Proxy, error) {
-	targetUrl := &url.URL{
-		Scheme: config.TargetProtocol,
-		Host:   net.JoinHostPort(config.TargetHost, config.TargetPort),
+	address := net.JoinHostPort(config.Host, config.Port)
+	rec := metrics.NewRecorder(address, string(session.HTTP))
+	wsRec := metrics.NewRecorder(address, string(session.HTTPWS))
+	pool := upstream.New(config.Upstream, net.JoinHostPort(config.TargetHost, config.TargetPort), logger)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = tracing.WrapDial(transport.DialContext)
+	transport.TLSClientConfig = config.UpstreamTLSConfig
+	wsDialer := *websocket.DefaultDialer
+	wsDialer.NetDialContext = tracing.WrapDial((&net.Dialer{}).DialContext)
+	wsDialer.TLSClientConfig = config.UpstreamTLSConfig
+	targets := make(map[string]*httputil.ReverseProxy)
+	for _, t := range pool.Targets() {
+		targets[t.Addr()] = newReverseProxy(config.TargetProtocol, t, transport, rec, logger)
 	}
 
 	bpc, err := NewBypassChecker(bypassPaths)
@@ -163,24 +346,55 @@ func NewProxy(config mgate.Config, handler session.Handler, logger *slog.Logger,
 
 	return Proxy{
 		config:     config,
-		target:     httputil.NewSingleHostReverseProxy(targetUrl),
-		session:    handler,
+		targets:    targets,
+		pool:       pool,
+		session:    session.InstrumentHandler(handler, rec),
+		wsSession:  session.InstrumentHandler(handler, wsRec),
 		logger:     logger,
 		wsUpgrader: wsUpgrader,
+		wsDialer:   &wsDialer,
 		bypass:     bpc,
+		limiter:    ratelimit.New(config.RateLimit),
+		conns:      connlimit.New(config.ConnLimits, logger),
+		group:      session.NewGroup(),
+		metrics:    rec,
+		wsMetrics:  wsRec,
 	}, nil
 }
 
+// shutdown stops accepting new connections, and waits for the in-flight requests to finish
+// for up to the shutdown timeout. Hijacked WebSocket connections are not tracked by the
+// server, so they are closed with the "going away" close frame and drained separately.
+func (p Proxy) shutdown(server *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ShutdownTimeout)
+	defer cancel()
+	p.logger.Info(fmt.Sprintf("HTTP proxy server draining %d WebSocket sessions", p.group.Len()))
+	if err := errors.Join(server.Shutdown(ctx), p.group.Shutdown(ctx)); err != nil {
+		return errors.Join(err, server.Close())
+	}
+	return nil
+}
+
 func (p Proxy) Listen(ctx context.Context) error {
+	if err := p.config.Upstream.ValidateCheck("tcp"); err != nil {
+		return err
+	}
 	listenAddress := net.JoinHostPort(p.config.Host, p.config.Port)
 	l, err := net.Listen("tcp", listenAddress)
 	if err != nil {
 		return err
 	}
 
+	// PROXY protocol header precedes any other data, and it has the client
+	// address the client connection limits apply to. The total limit applies
+	// before the header is read, so the pending headers are limited too.
+	l = connlimit.NewReservingListener(l, p.conns)
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.logger)
+	l = connlimit.NewListener(l, p.conns)
 	if p.config.TLSConfig != nil {
 		l = tls.NewListener(l, p.config.TLSConfig)
 	}
+	p.metrics.Connections(p.conns.Stats)
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 
 	p.logger.Info(fmt.Sprintf("HTTP proxy server started at %s%s with %s", listenAddress, p.config.PathPrefix, status))
@@ -192,14 +406,29 @@ func (p Proxy) Listen(ctx context.Context) error {
 
 	mux.Handle(transport.AddSuffixSlash(p.config.PathPrefix), p)
 	server.Handler = mux
+	server.ConnContext = proxyproto.NewContext
+	server.ErrorLog = p.metrics.ErrorLog(p.logger)
+
+	g.Go(func() error {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		p.pool.Run(ctx, p.dialTarget)
+		return nil
+	})
 
 	g.Go(func() error {
-		return server.Serve(l)
+		p.config.Certificates.Watch(ctx, p.logger)
+		return nil
 	})
 
 	g.Go(func() error {
 		<-ctx.Done()
-		return server.Close()
+		return p.shutdown(&server)
 	})
 	if err := g.Wait(); err != nil {
 		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting with errors", listenAddress, p.config.PathPrefix, status), slog.String("error", err.Error()))
@@ -10,29 +10,48 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/ratelimit"
 	"github.com/absmach/mgate/pkg/session"
+	"github.com/absmach/mgate/pkg/tracing"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
 	upstreamDesc   = "from mGate Proxy to websocket server"
 	downStreamDesc = "from websocket server to mGate Proxy"
+
+	closeTimeout = 5 * time.Second
 )
 
 func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, s *session.Session) {
 	topic := r.URL.Path
-	ctx := session.NewContext(context.Background(), s)
-	if err := p.session.AuthConnect(ctx); err != nil {
+	if p.config.MaxTopicLength > 0 && len(topic) > p.config.MaxTopicLength {
+		encodeError(w, http.StatusRequestURITooLong, session.ErrTopicTooLong)
+		return
+	}
+	m, err := p.group.Join()
+	if err != nil {
+		encodeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer m.Leave()
+	// The WebSocket connection is not canceled with the request, which is traced as the connection.
+	ctx := session.NewContext(context.WithoutCancel(r.Context()), s)
+	if err := p.wsSession.AuthConnect(ctx); err != nil {
 		encodeError(w, http.StatusUnauthorized, err)
 		return
 	}
-	if err := p.session.AuthSubscribe(ctx, &[]string{topic}); err != nil {
+	if err := p.wsSession.AuthSubscribe(ctx, &[]string{topic}); err != nil {
 		encodeError(w, http.StatusUnauthorized, err)
 		return
 	}
-	if err := p.session.Subscribe(ctx, &[]string{topic}); err != nil {
+	if err := p.wsSession.Subscribe(ctx, &[]string{topic}); err != nil {
 		encodeError(w, http.StatusBadRequest, err)
 		return
 	}
@@ -43,10 +62,19 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, s *sessi
 		header.Set(authzHeaderKey, auth)
 	}
 
-	target := fmt.Sprintf("%s://%s:%s%s", wsScheme(p.config.TargetProtocol), p.config.TargetHost, p.config.TargetPort, r.URL.RequestURI())
+	t, err := p.pool.Acquire(p.pool.Key(s.ID, s.Username))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer t.Release()
+	target := fmt.Sprintf("%s://%s%s", wsScheme(p.config.TargetProtocol), t.Addr(), r.URL.RequestURI())
+	tracing.Inject(ctx, propagation.HeaderCarrier(header))
 
-	targetConn, _, err := websocket.DefaultDialer.Dial(target, header)
+	targetConn, _, err := p.wsDialer.DialContext(ctx, target, header)
+	t.Report(err)
 	if err != nil {
+		p.wsMetrics.DialFailed()
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
@@ -58,12 +86,30 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, s *sessi
 		return
 	}
 	defer inConn.Close()
+	if p.config.MaxPacketSize > 0 {
+		// The connection is closed with the message too big close code on larger messages.
+		inConn.SetReadLimit(int64(p.config.MaxPacketSize))
+	}
+
+	entry := p.config.Registry.Register(session.HTTPWS, inConn.RemoteAddr())
+	defer p.config.Registry.Unregister(entry)
+	entry.SetClient(s.ID, s.Username)
+	entry.OnDisconnect(func() error {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session closed by administrator")
+		err := inConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+		return errors.Join(err, inConn.Close(), targetConn.Close())
+	})
+	m.OnShutdown(func() error {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		err := inConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+		return errors.Join(err, inConn.Close(), targetConn.Close())
+	})
 
 	g, ctx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
 		upstream := true
-		err := p.stream(ctx, topic, inConn, targetConn, upstream)
+		err := p.stream(ctx, topic, inConn, targetConn, entry, upstream)
 		if err := targetConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "client closed")); err != nil {
 			p.logger.Debug("mGate proxy unable to send close message to websocket server", slog.Any("error", err))
 		}
@@ -74,7 +120,7 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, s *sessi
 	})
 	g.Go(func() error {
 		upstream := false
-		err := p.stream(ctx, topic, targetConn, inConn, upstream)
+		err := p.stream(ctx, topic, targetConn, inConn, entry, upstream)
 		if err := inConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "client closed")); err != nil {
 			p.logger.Debug("mGate proxy unable to send close message to websocket client", slog.Any("error", err))
 		}
@@ -85,7 +131,7 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, s *sessi
 	})
 
 	gErr := g.Wait()
-	if err := p.session.Unsubscribe(ctx, &[]string{topic}); err != nil {
+	if err := p.wsSession.Unsubscribe(ctx, &[]string{topic}); err != nil {
 		p.logger.Error("Unsubscribe failed", slog.String("topic", topic), slog.Any("error", err))
 	}
 	if gErr != nil {
@@ -95,28 +141,88 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, s *sessi
 	p.logger.Info("WS Proxy session terminated")
 }
 
-func (p *Proxy) stream(ctx context.Context, topic string, src, dest *websocket.Conn, upstream bool) error {
+func (p *Proxy) stream(ctx context.Context, topic string, src, dest *websocket.Conn, entry *session.Entry, upstream bool) error {
 	for {
 		messageType, payload, err := src.ReadMessage()
 		if err != nil {
 			return handleStreamErr(err, upstream)
 		}
-		switch upstream {
-		case true:
-			if err := p.session.AuthPublish(ctx, &topic, &payload); err != nil {
-				return err
-			}
-			if err := p.session.Publish(ctx, &topic, &payload); err != nil {
+		if upstream {
+			entry.Received(1, len(payload))
+			drop, err := p.rateLimit(ctx, src, len(payload))
+			if err != nil {
 				return err
 			}
-		default:
-			if err := p.session.AuthSubscribe(ctx, &[]string{topic}); err != nil {
-				return err
+			if drop {
+				continue
 			}
 		}
-		if err := dest.WriteMessage(messageType, payload); err != nil {
+		direction := metrics.Up
+		if !upstream {
+			direction = metrics.Down
+		}
+		// Each message has its own trace linked to the connection.
+		mctx, span := tracing.StartMessage(ctx, wsMessageType(messageType), nil, trace.WithAttributes(
+			tracing.ProtocolKey.String(string(session.HTTPWS)),
+			tracing.DirectionKey.String(direction),
+			tracing.TopicKey.String(topic)))
+		err = p.forwardMessage(session.NewMessageContext(mctx, &session.Message{Protocol: session.HTTPWS}), &topic, messageType, &payload, dest, upstream)
+		tracing.End(span, err)
+		if err != nil {
 			return err
 		}
+		if !upstream {
+			entry.Sent(1, len(payload))
+		}
+		p.wsMetrics.Packet(direction, wsMessageType(messageType), len(payload))
+	}
+}
+
+// forwardMessage authorizes the message, and writes it to the destination.
+// Topic and payload are passed by reference, so the handler can modify them.
+func (p *Proxy) forwardMessage(ctx context.Context, topic *string, messageType int, payload *[]byte, dest *websocket.Conn, upstream bool) error {
+	switch upstream {
+	case true:
+		if err := p.wsSession.AuthPublish(ctx, topic, payload); err != nil {
+			return err
+		}
+		if err := p.wsSession.Publish(ctx, topic, payload); err != nil {
+			return err
+		}
+	default:
+		if err := p.wsSession.AuthSubscribe(ctx, &[]string{*topic}); err != nil {
+			return err
+		}
+	}
+	_, span := tracing.Start(ctx, tracing.Write)
+	err := dest.WriteMessage(messageType, *payload)
+	tracing.End(span, err)
+	return err
+}
+
+// rateLimit applies the session rate limit to the client message. It returns true if
+// the message must be dropped, or an error if the client must be disconnected.
+func (p *Proxy) rateLimit(ctx context.Context, src *websocket.Conn, size int) (bool, error) {
+	s, ok := session.FromContext(ctx)
+	if !ok {
+		return false, nil
+	}
+	key := p.limiter.Key(s.ID, s.Username, src.RemoteAddr().String())
+	err := p.limiter.Wait(ctx, key, s.RateLimit, size)
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Is(err, ratelimit.ErrDropped):
+		p.logger.Debug("WS Proxy dropped message over the rate limit", slog.String("key", key))
+		return true, nil
+	case errors.Is(err, ratelimit.ErrLimitExceeded):
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+		if err := src.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout)); err != nil {
+			p.logger.Debug("mGate proxy unable to send close message to websocket client", slog.Any("error", err))
+		}
+		return false, err
+	default:
+		return false, err
 	}
 }
 
@@ -142,6 +248,18 @@ func getPrefix(upstream bool) string {
 	return prefix
 }
 
+// wsMessageType returns the name of the WebSocket message type used as the packet type in the metrics.
+func wsMessageType(t int) string {
+	switch t {
+	case websocket.TextMessage:
+		return "text"
+	case websocket.BinaryMessage:
+		return "binary"
+	default:
+		return "control"
+	}
+}
+
 func wsScheme(scheme string) string {
 	switch scheme {
 	case "http":
@@ -0,0 +1,269 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics exports Prometheus metrics of the mGate proxies.
+package metrics
+
+import (
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absmach/mgate/pkg/connlimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "mgate"
+
+	// handshakeError is the prefix of the TLS handshake errors logged by http.Server.
+	handshakeError = "http: TLS handshake error"
+)
+
+// Packet directions. Up is from the client to the server, and Down is the other way around.
+const (
+	Up   = "up"
+	Down = "down"
+)
+
+// Certificate verification outcomes.
+const (
+	Valid   = "valid"
+	Revoked = "revoked"
+	Unknown = "unknown"
+	Failed  = "error"
+)
+
+var labels = []string{"listener", "protocol"}
+
+var (
+	packets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_total",
+		Help:      "Number of packets proxied by direction and packet type.",
+	}, append(labels, "direction", "type"))
+	bytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Number of bytes proxied by direction and packet type.",
+	}, append(labels, "direction", "type"))
+	hookDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hook_duration_seconds",
+		Help:      "Latency of the handler hooks.",
+		Buckets:   prometheus.DefBuckets,
+	}, append(labels, "hook"))
+	hookErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hook_errors_total",
+		Help:      "Number of errors returned by the handler hooks.",
+	}, append(labels, "hook"))
+	handshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_handshake_failures_total",
+		Help:      "Number of failed TLS and DTLS handshakes by reason.",
+	}, append(labels, "reason"))
+	dialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_failures_total",
+		Help:      "Number of failed connections to the upstream server.",
+	}, labels)
+	certVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cert_verifications_total",
+		Help:      "Number of client certificate revocation checks by method and outcome.",
+	}, []string{"method", "outcome"})
+
+	conns = newConnCollector()
+)
+
+func init() {
+	prometheus.MustRegister(conns)
+}
+
+// Handler returns the HTTP handler that serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// CertVerified records the outcome of the client certificate verification with the method, such as "ocsp".
+func CertVerified(method, outcome string) {
+	certVerifications.WithLabelValues(method, outcome).Inc()
+}
+
+// Recorder records the metrics of the proxy listening at the address.
+// All the methods are safe to call on nil Recorder, which does not record anything.
+type Recorder struct {
+	listener string
+	protocol string
+
+	packets           *prometheus.CounterVec
+	bytes             *prometheus.CounterVec
+	hookDuration      prometheus.ObserverVec
+	hookErrors        *prometheus.CounterVec
+	handshakeFailures *prometheus.CounterVec
+	dialFailures      prometheus.Counter
+}
+
+// NewRecorder returns the recorder of the metrics of the listener with the given address and protocol.
+func NewRecorder(listener, protocol string) *Recorder {
+	l := prometheus.Labels{"listener": listener, "protocol": protocol}
+	return &Recorder{
+		listener:          listener,
+		protocol:          protocol,
+		packets:           packets.MustCurryWith(l),
+		bytes:             bytes.MustCurryWith(l),
+		hookDuration:      hookDuration.MustCurryWith(l),
+		hookErrors:        hookErrors.MustCurryWith(l),
+		handshakeFailures: handshakeFailures.MustCurryWith(l),
+		dialFailures:      dialFailures.With(l),
+	}
+}
+
+// Connections exports the connection counters of the listener.
+func (r *Recorder) Connections(stats func() connlimit.Stats) {
+	if r == nil {
+		return
+	}
+	conns.add(r.listener, r.protocol, stats)
+}
+
+// Packet records the packet of the given type, and its size in bytes.
+func (r *Recorder) Packet(direction, typ string, size int) {
+	if r == nil {
+		return
+	}
+	r.packets.WithLabelValues(direction, typ).Inc()
+	r.bytes.WithLabelValues(direction, typ).Add(float64(size))
+}
+
+// Hook records the latency of the handler hook that started at the given time, and its error.
+func (r *Recorder) Hook(hook string, start time.Time, err error) {
+	if r == nil {
+		return
+	}
+	r.hookDuration.WithLabelValues(hook).Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.hookErrors.WithLabelValues(hook).Inc()
+	}
+}
+
+// HandshakeFailed records the failed TLS or DTLS handshake.
+func (r *Recorder) HandshakeFailed(err error) {
+	if r == nil {
+		return
+	}
+	r.handshakeFailures.WithLabelValues(reason(err)).Inc()
+}
+
+// ErrorLog returns the logger for http.Server.ErrorLog that records the TLS handshake
+// failures reported by the server, and passes all the messages to the logger.
+func (r *Recorder) ErrorLog(logger *slog.Logger) *log.Logger {
+	if r == nil {
+		return nil
+	}
+	return log.New(errorLog{recorder: r, logger: logger}, "", 0)
+}
+
+// DialFailed records the failed connection to the upstream server.
+func (r *Recorder) DialFailed() {
+	if r == nil {
+		return
+	}
+	r.dialFailures.Inc()
+}
+
+type errorLog struct {
+	recorder *Recorder
+	logger   *slog.Logger
+}
+
+func (l errorLog) Write(b []byte) (int, error) {
+	msg := strings.TrimSpace(string(b))
+	if strings.HasPrefix(msg, handshakeError) {
+		l.recorder.HandshakeFailed(errors.New(msg))
+	}
+	l.logger.Warn(msg)
+	return len(b), nil
+}
+
+// reason returns the short reason of the handshake failure used as the label value.
+func reason(err error) string {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, io.EOF) {
+		return "eof"
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "deadline exceeded"):
+		return "timeout"
+	case strings.Contains(msg, "eof"), strings.Contains(msg, "connection reset"):
+		return "eof"
+	case strings.Contains(msg, "does not look like a tls handshake"):
+		return "not_tls"
+	case strings.Contains(msg, "revoked"):
+		return "revoked"
+	case strings.Contains(msg, "didn't provide a certificate"), strings.Contains(msg, "certificate is required"):
+		return "no_client_certificate"
+	case strings.Contains(msg, "certificate"):
+		return "bad_certificate"
+	default:
+		return "protocol"
+	}
+}
+
+// connCollector exports the connection counters of the listeners.
+type connCollector struct {
+	active   *prometheus.Desc
+	accepted *prometheus.Desc
+	rejected *prometheus.Desc
+
+	mu    sync.Mutex
+	stats map[[2]string]func() connlimit.Stats
+}
+
+func newConnCollector() *connCollector {
+	return &connCollector{
+		active: prometheus.NewDesc(prometheus.BuildFQName(namespace, "connections", "active"),
+			"Number of the open client connections.", labels, nil),
+		accepted: prometheus.NewDesc(prometheus.BuildFQName(namespace, "connections", "accepted_total"),
+			"Number of the accepted client connections.", labels, nil),
+		rejected: prometheus.NewDesc(prometheus.BuildFQName(namespace, "connections", "rejected_total"),
+			"Number of the client connections rejected by the connection limits.", labels, nil),
+		stats: make(map[[2]string]func() connlimit.Stats),
+	}
+}
+
+func (c *connCollector) add(listener, protocol string, stats func() connlimit.Stats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats[[2]string{listener, protocol}] = stats
+}
+
+func (c *connCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.accepted
+	ch <- c.rejected
+}
+
+func (c *connCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for l, stats := range c.stats {
+		s := stats()
+		ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(s.Active), l[0], l[1])
+		ch <- prometheus.MustNewConstMetric(c.accepted, prometheus.CounterValue, float64(s.Accepted), l[0], l[1])
+		ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(s.Rejected), l[0], l[1])
+	}
+}
@@ -6,14 +6,22 @@ package mqtt
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 
 	"github.com/absmach/mgate"
+	"github.com/absmach/mgate/pkg/connlimit"
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/proxyproto"
+	"github.com/absmach/mgate/pkg/ratelimit"
 	"github.com/absmach/mgate/pkg/session"
 	mptls "github.com/absmach/mgate/pkg/tls"
+	"github.com/absmach/mgate/pkg/tracing"
+	"github.com/absmach/mgate/pkg/upstream"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -25,6 +33,11 @@ type Proxy struct {
 	afterHandler  session.Interceptor
 	logger        *slog.Logger
 	dialer        net.Dialer
+	limiter       *ratelimit.Limiter
+	conns         *connlimit.Limiter
+	pool          *upstream.Pool
+	group         *session.Group
+	metrics       *metrics.Recorder
 }
 
 // New returns a new MQTT Proxy instance.
@@ -35,6 +48,11 @@ func New(config mgate.Config, handler session.Handler, beforeHandler, afterHandl
 		logger:        logger,
 		beforeHandler: beforeHandler,
 		afterHandler:  afterHandler,
+		limiter:       ratelimit.New(config.RateLimit),
+		conns:         connlimit.New(config.ConnLimits, logger),
+		pool:          upstream.New(config.Upstream, net.JoinHostPort(config.TargetHost, config.TargetPort), logger),
+		group:         session.NewGroup(),
+		metrics:       metrics.NewRecorder(net.JoinHostPort(config.Host, config.Port), string(session.MQTT)),
 	}
 }
 
@@ -57,36 +75,57 @@ func (p Proxy) accept(ctx context.Context, l net.Listener) {
 
 func (p Proxy) handle(ctx context.Context, inbound net.Conn) {
 	defer p.close(inbound)
-	targetAddress := net.JoinHostPort(p.config.TargetHost, p.config.TargetPort)
-	outbound, err := p.dialer.Dial("tcp", targetAddress)
-	if err != nil {
-		p.logger.Error("Cannot connect to remote broker " + targetAddress + " due to: " + err.Error())
-		return
-	}
-	defer p.close(outbound)
-
-	clientCert, err := mptls.ClientCert(inbound)
+	// The session outlives the listener, so it can be closed gracefully on shutdown.
+	ctx = context.WithoutCancel(ctx)
+	ctx, span := tracing.StartConnection(ctx, string(session.MQTT), inbound.RemoteAddr())
+	clientCert, err := p.clientCert(ctx, inbound)
 	if err != nil {
+		tracing.End(span, err)
+		p.metrics.HandshakeFailed(err)
 		p.logger.Error("Failed to get client certificate: " + err.Error())
 		return
 	}
 
-	if err = session.Stream(ctx, inbound, outbound, p.handler, p.beforeHandler, p.afterHandler, clientCert); err != io.EOF {
+	// The broker is dialed once the client CONNECT is authorized.
+	err = session.Stream(ctx, inbound, nil, p.handler, p.beforeHandler, p.afterHandler, clientCert, p.sessionOptions(inbound)...)
+	tracing.End(span, err)
+	if err != io.EOF {
 		p.logger.Warn(err.Error())
 	}
 }
 
+// clientCert completes the TLS handshake of the client connection, and returns the client certificate.
+func (p Proxy) clientCert(ctx context.Context, inbound net.Conn) (x509.Certificate, error) {
+	if p.config.TLSConfig == nil {
+		return x509.Certificate{}, nil
+	}
+	_, span := tracing.Start(ctx, tracing.Handshake)
+	cert, err := mptls.ClientCert(inbound)
+	tracing.End(span, err)
+	return cert, err
+}
+
 // Listen of the server, this will block.
 func (p Proxy) Listen(ctx context.Context) error {
+	if err := p.config.Upstream.ValidateCheck("tcp"); err != nil {
+		return err
+	}
 	listenAddress := net.JoinHostPort(p.config.Host, p.config.Port)
 	l, err := net.Listen("tcp", listenAddress)
 	if err != nil {
 		return err
 	}
 
+	// PROXY protocol header precedes any other data, and it has the client
+	// address the client connection limits apply to. The total limit applies
+	// before the header is read, so the pending headers are limited too.
+	l = connlimit.NewReservingListener(l, p.conns)
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.logger)
+	l = connlimit.NewListener(l, p.conns)
 	if p.config.TLSConfig != nil {
 		l = tls.NewListener(l, p.config.TLSConfig)
 	}
+	p.metrics.Connections(p.conns.Stats)
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 	p.logger.Info(fmt.Sprintf("MQTT proxy server started at %s  with %s", listenAddress, status))
 	g, ctx := errgroup.WithContext(ctx)
@@ -97,9 +136,20 @@ func (p Proxy) Listen(ctx context.Context) error {
 		return nil
 	})
 
+	g.Go(func() error {
+		p.pool.Run(ctx, p.dialTarget(proxyproto.NewLocalHeader(p.config.Upstream.ProxyProtocol)))
+		return nil
+	})
+
+	g.Go(func() error {
+		p.config.Certificates.Watch(ctx, p.logger)
+		return nil
+	})
+
 	g.Go(func() error {
 		<-ctx.Done()
-		return l.Close()
+		// Stop accepting new clients, and drain the open sessions.
+		return errors.Join(l.Close(), p.shutdown())
 	})
 	if err := g.Wait(); err != nil {
 		p.logger.Info(fmt.Sprintf("MQTT proxy server at %s with %s exiting with errors", listenAddress, status), slog.String("error", err.Error()))
@@ -109,8 +159,86 @@ func (p Proxy) Listen(ctx context.Context) error {
 	return nil
 }
 
+// shutdown disconnects the open sessions, and waits for their Disconnect hooks to return
+// for up to the shutdown timeout.
+func (p Proxy) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ShutdownTimeout)
+	defer cancel()
+	p.logger.Info(fmt.Sprintf("MQTT proxy server draining %d sessions", p.group.Len()))
+	return p.group.Shutdown(ctx)
+}
+
 func (p Proxy) close(conn net.Conn) {
 	if err := conn.Close(); err != nil {
 		p.logger.Warn(fmt.Sprintf("Error closing connection %s", err.Error()))
 	}
 }
+
+// dial connects to the broker selected for the client of the session in the context.
+// PROXY protocol header with the inbound connection addresses is sent first, if enabled.
+func (p Proxy) dial(ctx context.Context, inbound net.Conn) (net.Conn, error) {
+	var key string
+	var header *proxyproto.Header
+	if s, ok := session.FromContext(ctx); ok {
+		key = p.pool.Key(s.ID, s.Username)
+		header = proxyproto.NewHeader(p.config.Upstream.ProxyProtocol, inbound.RemoteAddr(), inbound.LocalAddr(), s.Cert, mptls.Verified(inbound))
+	}
+	conn, err := p.pool.Dial(ctx, key, p.dialTarget(header))
+	if err != nil {
+		p.logger.Error("Cannot connect to remote broker due to: " + err.Error())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTarget returns the function that connects to the broker with the given address,
+// sends PROXY protocol header, if any, and completes the TLS handshake, if enabled.
+func (p Proxy) dialTarget(header *proxyproto.Header) upstream.DialFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := p.dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			if _, err := header.WriteTo(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if p.config.UpstreamTLSConfig == nil {
+			return conn, nil
+		}
+		config := p.config.UpstreamTLSConfig
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+func (p Proxy) sessionOptions(inbound net.Conn) []session.Option {
+	return []session.Option{
+		session.WithDenialPolicy(p.config.DenialPolicy),
+		session.WithLocalSubscriptionCheck(p.config.LocalSubCheck),
+		session.WithRegistry(p.config.Registry),
+		session.WithConnectTimeout(p.config.ConnectTimeout),
+		session.WithIdleTimeout(p.config.IdleTimeout),
+		session.WithRateLimiter(p.limiter),
+		session.WithGroup(p.group),
+		session.WithMetrics(p.metrics),
+		session.WithDialer(func(ctx context.Context) (net.Conn, error) {
+			return p.dial(ctx, inbound)
+		}),
+		session.WithLimits(session.Limits{
+			MaxPacketSize:      p.config.MaxPacketSize,
+			MaxTopicLength:     p.config.MaxTopicLength,
+			MaxSubscribeTopics: p.config.MaxSubTopics,
+		}),
+	}
+}
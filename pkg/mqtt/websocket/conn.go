@@ -77,3 +77,8 @@ func (c *wsWrapper) Read(p []byte) (int, error) {
 func (c *wsWrapper) Close() error {
 	return c.Conn.Close()
 }
+
+// NetConn returns the network connection the websocket is running on.
+func (c *wsWrapper) NetConn() net.Conn {
+	return c.UnderlyingConn()
+}
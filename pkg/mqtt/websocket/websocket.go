@@ -6,6 +6,7 @@ package websocket
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -14,10 +15,17 @@ import (
 	"time"
 
 	"github.com/absmach/mgate"
+	"github.com/absmach/mgate/pkg/connlimit"
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/proxyproto"
+	"github.com/absmach/mgate/pkg/ratelimit"
 	"github.com/absmach/mgate/pkg/session"
 	mptls "github.com/absmach/mgate/pkg/tls"
+	"github.com/absmach/mgate/pkg/tracing"
 	"github.com/absmach/mgate/pkg/transport"
+	"github.com/absmach/mgate/pkg/upstream"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/propagation"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -28,6 +36,11 @@ type Proxy struct {
 	beforeHandler session.Interceptor
 	afterHandler  session.Interceptor
 	logger        *slog.Logger
+	limiter       *ratelimit.Limiter
+	conns         *connlimit.Limiter
+	pool          *upstream.Pool
+	group         *session.Group
+	metrics       *metrics.Recorder
 }
 
 // New - creates new WS proxy.
@@ -37,6 +50,11 @@ func New(config mgate.Config, handler session.Handler, beforeHandler, afterHandl
 		handler:       handler,
 		beforeHandler: beforeHandler,
 		afterHandler:  afterHandler,
+		limiter:       ratelimit.New(config.RateLimit),
+		conns:         connlimit.New(config.ConnLimits, logger),
+		pool:          upstream.New(config.Upstream, net.JoinHostPort(config.TargetHost, config.TargetPort), logger),
+		group:         session.NewGroup(),
+		metrics:       metrics.NewRecorder(net.JoinHostPort(config.Host, config.Port), string(session.MQTTWS)),
 		logger:        logger,
 	}
 }
@@ -68,56 +86,126 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//nolint:contextcheck // new context is created in pass method
-	go p.pass(cconn)
+	go p.pass(cconn, r.Header)
 }
 
-func (p Proxy) pass(in *websocket.Conn) {
+func (p Proxy) pass(in *websocket.Conn, header http.Header) {
 	defer in.Close()
-	// Using a new context so as to avoiding infinitely long traces.
-	// And also avoiding proxy cancellation due to parent context cancellation.
-	ctx, cancel := context.WithCancel(context.Background())
+	// Using a new context so as to avoid proxy cancellation due to parent context cancellation.
+	// The connection span continues the trace of the upgrade request, while each packet starts
+	// a new trace linked to the connection span, so the connection trace is not infinitely long.
+	ctx, cancel := context.WithCancel(tracing.Extract(context.Background(), propagation.HeaderCarrier(header)))
 	defer cancel()
-	dialer := &websocket.Dialer{
-		Subprotocols: []string{"mqtt"},
-	}
-	target := fmt.Sprintf("%s://%s:%s", p.config.TargetProtocol, p.config.TargetHost, p.config.TargetPath)
-
-	srv, _, err := dialer.Dial(target, nil)
-	if err != nil {
-		p.logger.Error("Unable to connect to broker", slog.Any("error", err))
-		return
-	}
+	ctx, span := tracing.StartConnection(ctx, string(session.MQTTWS), in.RemoteAddr())
 
 	errc := make(chan error, 1)
 	inboundConn := newConn(in)
-	outboundConn := newConn(srv)
 
 	defer inboundConn.Close()
-	defer outboundConn.Close()
 
+	// The server records the failed handshakes, so only the ones
+	// of the connections that got this far are recorded here.
 	clientCert, err := mptls.ClientCert(in.UnderlyingConn())
 	if err != nil {
+		tracing.End(span, err)
+		p.metrics.HandshakeFailed(err)
 		p.logger.Error("Failed to get client certificate", slog.Any("error", err))
 		return
 	}
 
-	err = session.Stream(ctx, inboundConn, outboundConn, p.handler, p.beforeHandler, p.afterHandler, clientCert)
+	// The broker is dialed once the client CONNECT is authorized.
+	err = session.Stream(ctx, inboundConn, nil, p.handler, p.beforeHandler, p.afterHandler, clientCert, p.sessionOptions(inboundConn, header)...)
+	tracing.End(span, err)
 	errc <- err
 	p.logger.Warn("Broken connection for client", slog.Any("error", err))
 }
 
+// dial connects to the broker selected for the client of the session in the context.
+// PROXY protocol header with the inbound connection addresses is sent first, if enabled.
+func (p Proxy) dial(ctx context.Context, inbound net.Conn) (net.Conn, error) {
+	var key string
+	var header *proxyproto.Header
+	if s, ok := session.FromContext(ctx); ok {
+		key = p.pool.Key(s.ID, s.Username)
+		header = proxyproto.NewHeader(p.config.Upstream.ProxyProtocol, inbound.RemoteAddr(), inbound.LocalAddr(), s.Cert, mptls.Verified(inbound))
+	}
+	conn, err := p.pool.Dial(ctx, key, p.dialTarget(header))
+	if err != nil {
+		p.logger.Error("Unable to connect to broker", slog.Any("error", err))
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTarget returns the function that connects to the broker with the given address,
+// sends PROXY protocol header, if any, and upgrades the connection to WebSocket.
+func (p Proxy) dialTarget(header *proxyproto.Header) upstream.DialFunc {
+	dialer := &websocket.Dialer{
+		Subprotocols: []string{"mqtt"},
+		// Used only with wss target protocol.
+		TLSClientConfig: p.config.UpstreamTLSConfig,
+	}
+	if header != nil {
+		// The header precedes the TLS handshake and the upgrade request.
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := header.WriteTo(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		target := fmt.Sprintf("%s://%s%s", p.config.TargetProtocol, addr, p.config.TargetPath)
+		srv, _, err := dialer.DialContext(ctx, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		return newConn(srv), nil
+	}
+}
+
+// shutdown stops accepting new connections, disconnects the open sessions, and waits for
+// their Disconnect hooks to return for up to the shutdown timeout. Hijacked WebSocket
+// connections are not tracked by the server, so the sessions are drained separately.
+func (p Proxy) shutdown(server *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ShutdownTimeout)
+	defer cancel()
+	p.logger.Info(fmt.Sprintf("MQTT websocket proxy server draining %d sessions", p.group.Len()))
+	if err := errors.Join(server.Shutdown(ctx), p.group.Shutdown(ctx)); err != nil {
+		return errors.Join(err, server.Close())
+	}
+	return nil
+}
+
 func (p Proxy) Listen(ctx context.Context) error {
+	if err := p.config.Upstream.ValidateCheck("tcp"); err != nil {
+		return err
+	}
 	listenAddress := net.JoinHostPort(p.config.Host, p.config.Port)
 	l, err := net.Listen("tcp", listenAddress)
 	if err != nil {
 		return err
 	}
 
+	// PROXY protocol header precedes any other data, and it has the client
+	// address the client connection limits apply to. The total limit applies
+	// before the header is read, so the pending headers are limited too.
+	l = connlimit.NewReservingListener(l, p.conns)
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.logger)
+	l = connlimit.NewListener(l, p.conns)
 	if p.config.TLSConfig != nil {
 		l = tls.NewListener(l, p.config.TLSConfig)
 	}
+	p.metrics.Connections(p.conns.Stats)
 
 	var server http.Server
+	server.ErrorLog = p.metrics.ErrorLog(p.logger)
 	g, ctx := errgroup.WithContext(ctx)
 
 	mux := http.NewServeMux()
@@ -126,7 +214,20 @@ func (p Proxy) Listen(ctx context.Context) error {
 	server.Handler = mux
 
 	g.Go(func() error {
-		return server.Serve(l)
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		p.pool.Run(ctx, p.dialTarget(proxyproto.NewLocalHeader(p.config.Upstream.ProxyProtocol)))
+		return nil
+	})
+
+	g.Go(func() error {
+		p.config.Certificates.Watch(ctx, p.logger)
+		return nil
 	})
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 
@@ -134,7 +235,7 @@ func (p Proxy) Listen(ctx context.Context) error {
 
 	g.Go(func() error {
 		<-ctx.Done()
-		return server.Close()
+		return p.shutdown(&server)
 	})
 	if err := g.Wait(); err != nil {
 		p.logger.Info(fmt.Sprintf("MQTT websocket proxy server at %s%s with %s exiting with errors", listenAddress, p.config.PathPrefix, status), slog.String("error", err.Error()))
@@ -143,3 +244,26 @@ func (p Proxy) Listen(ctx context.Context) error {
 	}
 	return nil
 }
+
+func (p Proxy) sessionOptions(inbound net.Conn, header http.Header) []session.Option {
+	return []session.Option{
+		session.WithDenialPolicy(p.config.DenialPolicy),
+		session.WithLocalSubscriptionCheck(p.config.LocalSubCheck),
+		session.WithRegistry(p.config.Registry),
+		session.WithConnectTimeout(p.config.ConnectTimeout),
+		session.WithIdleTimeout(p.config.IdleTimeout),
+		session.WithRateLimiter(p.limiter),
+		session.WithGroup(p.group),
+		session.WithMetrics(p.metrics),
+		session.WithDialer(func(ctx context.Context) (net.Conn, error) {
+			return p.dial(ctx, inbound)
+		}),
+		session.WithLimits(session.Limits{
+			MaxPacketSize:      p.config.MaxPacketSize,
+			MaxTopicLength:     p.config.MaxTopicLength,
+			MaxSubscribeTopics: p.config.MaxSubTopics,
+		}),
+		session.WithProtocol(session.MQTTWS),
+		session.WithHeader(header),
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package proxyproto implements PROXY protocol versions 1 and 2, which pass the
+// original client address through load balancers.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Command is the PROXY protocol command.
+type Command byte
+
+const (
+	// Local is used by the connections opened by the load balancer itself, such as health checks.
+	// The connection addresses are used as is.
+	Local Command = 0x0
+	// Proxy is used by the connections relayed on behalf of the client.
+	Proxy Command = 0x1
+)
+
+// TLV types defined by PROXY protocol version 2.
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+
+	subtypeSSLVersion byte = 0x21
+	subtypeSSLCN      byte = 0x22
+	subtypeSSLCipher  byte = 0x23
+	subtypeSSLSigAlg  byte = 0x24
+	subtypeSSLKeyAlg  byte = 0x25
+)
+
+// SSL client flags of the SSL TLV.
+const (
+	ClientSSL      byte = 0x01
+	ClientCertConn byte = 0x02
+	ClientCertSess byte = 0x04
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+	v2HeaderLen = 16
+	v2Version   = 0x20
+
+	famUnspec = 0x0
+	famInet   = 0x1
+	famInet6  = 0x2
+	famUnix   = 0x3
+
+	lenInet  = 12
+	lenInet6 = 36
+	lenUnix  = 216
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// ErrNoHeader indicates the connection does not start with PROXY protocol header.
+	ErrNoHeader = errors.New("missing PROXY protocol header")
+
+	// ErrInvalidHeader indicates PROXY protocol header is malformed.
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+// TLV is a type-length-value field of PROXY protocol version 2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// SSL is the information about the TLS connection terminated by the load balancer.
+type SSL struct {
+	// Client holds ClientSSL, ClientCertConn and ClientCertSess flags.
+	Client byte
+	// Verify is zero if the client certificate is verified successfully.
+	Verify  uint32
+	Version string
+	// CN is the common name of the client certificate subject.
+	CN     string
+	Cipher string
+	SigAlg string
+	KeyAlg string
+}
+
+// Header is PROXY protocol header.
+type Header struct {
+	Version     int
+	Command     Command
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// TLV returns the value of the first TLV with the given type.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+	for _, t := range h.TLVs {
+		if t.Type == typ {
+			return t.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name sent by the client with TLS SNI.
+func (h *Header) Authority() string {
+	v, _ := h.TLV(TypeAuthority)
+	return string(v)
+}
+
+// SSL returns the information about the TLS connection terminated by the load balancer.
+func (h *Header) SSL() (SSL, bool) {
+	v, ok := h.TLV(TypeSSL)
+	if !ok || len(v) < 5 {
+		return SSL{}, false
+	}
+	ssl := SSL{
+		Client: v[0],
+		Verify: binary.BigEndian.Uint32(v[1:5]),
+	}
+	tlvs, err := parseTLVs(v[5:])
+	if err != nil {
+		return SSL{}, false
+	}
+	for _, t := range tlvs {
+		switch t.Type {
+		case subtypeSSLVersion:
+			ssl.Version = string(t.Value)
+		case subtypeSSLCN:
+			ssl.CN = string(t.Value)
+		case subtypeSSLCipher:
+			ssl.Cipher = string(t.Value)
+		case subtypeSSLSigAlg:
+			ssl.SigAlg = string(t.Value)
+		case subtypeSSLKeyAlg:
+			ssl.KeyAlg = string(t.Value)
+		}
+	}
+	return ssl, true
+}
+
+// Read reads PROXY protocol header of either version from the reader.
+func Read(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == v1Prefix {
+		return readV1(r)
+	}
+	b, err = r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// readV1 reads the human-readable header, such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n".
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Split(s, " ")
+	h := &Header{Version: 1, Command: Proxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Command = Local
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string) (net.Addr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readV2 reads the binary header.
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [v2HeaderLen]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]&0xF0 != v2Version {
+		return nil, ErrInvalidHeader
+	}
+	h := &Header{Version: 2, Command: Command(fixed[12] & 0x0F)}
+	if h.Command != Local && h.Command != Proxy {
+		return nil, ErrInvalidHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	fam, proto := fixed[13]>>4, fixed[13]&0x0F
+	switch fam {
+	case famInet:
+		addrLen = lenInet
+	case famInet6:
+		addrLen = lenInet6
+	case famUnix:
+		addrLen = lenUnix
+	case famUnspec:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(payload) < addrLen {
+		return nil, ErrInvalidHeader
+	}
+	if h.Command == Proxy {
+		switch fam {
+		case famInet:
+			h.Source, h.Destination = inetAddrs(payload[:lenInet], net.IPv4len, proto)
+		case famInet6:
+			h.Source, h.Destination = inetAddrs(payload[:lenInet6], net.IPv6len, proto)
+		case famUnix:
+			h.Source = &net.UnixAddr{Name: cString(payload[:108]), Net: "unix"}
+			h.Destination = &net.UnixAddr{Name: cString(payload[108:lenUnix]), Net: "unix"}
+		}
+	}
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+func inetAddrs(b []byte, ipLen int, proto byte) (net.Addr, net.Addr) {
+	srcIP := net.IP(bytes.Clone(b[:ipLen]))
+	dstIP := net.IP(bytes.Clone(b[ipLen : 2*ipLen]))
+	srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
+	// Protocol 0x2 is DGRAM.
+	if proto == 0x2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrInvalidHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, ErrInvalidHeader
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (c Command) String() string {
+	switch c {
+	case Local:
+		return "LOCAL"
+	case Proxy:
+		return "PROXY"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", byte(c))
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2 returns the binary header with the given command, family and protocol byte, and payload.
+func v2(cmd Command, fam byte, payload []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, v2Version|byte(cmd), fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func inet(src, dst string, srcPort, dstPort uint16) []byte {
+	var b []byte
+	for _, ip := range []string{src, dst} {
+		addr := net.ParseIP(ip)
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+		b = append(b, addr...)
+	}
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	return binary.BigEndian.AppendUint16(b, dstPort)
+}
+
+func unix(src, dst string) []byte {
+	b := make([]byte, lenUnix)
+	copy(b, src)
+	copy(b[108:], dst)
+	return b
+}
+
+func tlv(typ byte, value string) []byte {
+	return appendTLV(nil, TLV{Type: typ, Value: []byte(value)})
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.Network() + " " + a.String()
+}
+
+func TestRead(t *testing.T) {
+	cases := []struct {
+		desc    string
+		data    []byte
+		version int
+		command Command
+		src     string
+		dst     string
+		tlvs    []TLV
+		err     error
+	}{
+		{
+			desc:    "v1 TCP4",
+			data:    []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n"),
+			version: 1,
+			command: Proxy,
+			src:     "tcp 192.0.2.1:56324",
+			dst:     "tcp 192.0.2.2:1883",
+		},
+		{
+			desc:    "v1 TCP6",
+			data:    []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"),
+			version: 1,
+			command: Proxy,
+			src:     "tcp [2001:db8::1]:56324",
+			dst:     "tcp [2001:db8::2]:1883",
+		},
+		{
+			desc:    "v1 UNKNOWN",
+			data:    []byte("PROXY UNKNOWN\r\n"),
+			version: 1,
+			command: Local,
+		},
+		{
+			desc:    "v1 UNKNOWN with addresses",
+			data:    []byte("PROXY UNKNOWN 2001:db8::1 2001:db8::2 56324 1883\r\n"),
+			version: 1,
+			command: Local,
+		},
+		{
+			desc: "v1 at the length limit",
+			data: []byte("PROXY UNKNOWN " + strings.Repeat("f", v1MaxLength-len("PROXY UNKNOWN \r\n")) + "\r\n"),
+			// The limit includes CRLF, so the longest header is still accepted.
+			version: 1,
+			command: Local,
+		},
+		{
+			desc: "v1 over the length limit",
+			data: []byte("PROXY UNKNOWN " + strings.Repeat("f", v1MaxLength) + "\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v1 without CRLF",
+			data: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v1 unknown protocol",
+			data: []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 1883\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v1 missing port",
+			data: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v1 invalid address",
+			data: []byte("PROXY TCP4 192.0.2 192.0.2.2 56324 1883\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v1 port out of range",
+			data: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 1883\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v1 truncated",
+			data: []byte("PROXY TCP4 192.0.2.1"),
+			err:  io.EOF,
+		},
+		{
+			desc:    "v2 TCP over IPv4",
+			data:    v2(Proxy, famInet<<4|0x1, inet("192.0.2.1", "192.0.2.2", 56324, 1883)),
+			version: 2,
+			command: Proxy,
+			src:     "tcp 192.0.2.1:56324",
+			dst:     "tcp 192.0.2.2:1883",
+		},
+		{
+			desc:    "v2 UDP over IPv4",
+			data:    v2(Proxy, famInet<<4|0x2, inet("192.0.2.1", "192.0.2.2", 56324, 5684)),
+			version: 2,
+			command: Proxy,
+			src:     "udp 192.0.2.1:56324",
+			dst:     "udp 192.0.2.2:5684",
+		},
+		{
+			desc:    "v2 TCP over IPv6",
+			data:    v2(Proxy, famInet6<<4|0x1, inet("2001:db8::1", "2001:db8::2", 56324, 1883)),
+			version: 2,
+			command: Proxy,
+			src:     "tcp [2001:db8::1]:56324",
+			dst:     "tcp [2001:db8::2]:1883",
+		},
+		{
+			desc:    "v2 UNIX",
+			data:    v2(Proxy, famUnix<<4|0x1, unix("/tmp/client.sock", "/tmp/mgate.sock")),
+			version: 2,
+			command: Proxy,
+			src:     "unix /tmp/client.sock",
+			dst:     "unix /tmp/mgate.sock",
+		},
+		{
+			desc:    "v2 UNSPEC",
+			data:    v2(Proxy, famUnspec, nil),
+			version: 2,
+			command: Proxy,
+		},
+		{
+			desc:    "v2 LOCAL ignores the addresses",
+			data:    v2(Local, famInet<<4|0x1, inet("192.0.2.1", "192.0.2.2", 56324, 1883)),
+			version: 2,
+			command: Local,
+		},
+		{
+			desc:    "v2 with TLVs",
+			data:    v2(Proxy, famInet<<4|0x1, concat(inet("192.0.2.1", "192.0.2.2", 56324, 1883), tlv(TypeAuthority, "example.com"), tlv(TypeNoop, ""))),
+			version: 2,
+			command: Proxy,
+			src:     "tcp 192.0.2.1:56324",
+			dst:     "tcp 192.0.2.2:1883",
+			tlvs:    []TLV{{Type: TypeAuthority, Value: []byte("example.com")}, {Type: TypeNoop, Value: []byte{}}},
+		},
+		{
+			desc: "v2 length shorter than IPv4 addresses",
+			data: v2(Proxy, famInet<<4|0x1, inet("192.0.2.1", "192.0.2.2", 56324, 1883)[:lenInet-1]),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v2 length shorter than IPv6 addresses",
+			data: v2(Proxy, famInet6<<4|0x1, inet("192.0.2.1", "192.0.2.2", 56324, 1883)),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v2 length shorter than UNIX addresses",
+			data: v2(Proxy, famUnix<<4|0x1, unix("/tmp/client.sock", "/tmp/mgate.sock")[:lenUnix-1]),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v2 payload shorter than the length",
+			data: v2(Proxy, famInet<<4|0x1, inet("192.0.2.1", "192.0.2.2", 56324, 1883))[:v2HeaderLen+lenInet-1],
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			desc: "v2 TLV value truncated",
+			data: v2(Proxy, famInet<<4|0x1, concat(inet("192.0.2.1", "192.0.2.2", 56324, 1883), tlv(TypeAuthority, "example.com")[:6])),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v2 TLV length truncated",
+			data: v2(Proxy, famInet<<4|0x1, concat(inet("192.0.2.1", "192.0.2.2", 56324, 1883), []byte{TypeAuthority, 0x00})),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v2 unsupported version",
+			data: func() []byte {
+				b := v2(Proxy, famUnspec, nil)
+				b[12] = 0x10 | byte(Proxy)
+				return b
+			}(),
+			err: ErrInvalidHeader,
+		},
+		{
+			desc: "v2 unknown command",
+			data: v2(Command(0x2), famUnspec, nil),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "v2 unknown family",
+			data: v2(Proxy, 0x4<<4|0x1, inet("192.0.2.1", "192.0.2.2", 56324, 1883)),
+			err:  ErrInvalidHeader,
+		},
+		{
+			desc: "no header",
+			data: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+			err:  ErrNoHeader,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.err != nil {
+				if _, err := Read(bufio.NewReader(bytes.NewReader(tc.data))); !errors.Is(err, tc.err) {
+					t.Fatalf("expected error %v, got %v", tc.err, err)
+				}
+				return
+			}
+			// The data following the header must be left in the reader.
+			const rest = "\x10\x00"
+			r := bufio.NewReader(bytes.NewReader(append(tc.data, rest...)))
+			h, err := Read(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if h.Version != tc.version || h.Command != tc.command {
+				t.Fatalf("expected version %d %s header, got version %d %s", tc.version, tc.command, h.Version, h.Command)
+			}
+			if src := addrString(h.Source); src != tc.src {
+				t.Fatalf("expected source %q, got %q", tc.src, src)
+			}
+			if dst := addrString(h.Destination); dst != tc.dst {
+				t.Fatalf("expected destination %q, got %q", tc.dst, dst)
+			}
+			if len(h.TLVs) != len(tc.tlvs) {
+				t.Fatalf("expected %d TLVs, got %d", len(tc.tlvs), len(h.TLVs))
+			}
+			for i, want := range tc.tlvs {
+				if got := h.TLVs[i]; got.Type != want.Type || !bytes.Equal(got.Value, want.Value) {
+					t.Fatalf("expected TLV %v, got %v", want, got)
+				}
+			}
+			if b, _ := io.ReadAll(r); string(b) != rest {
+				t.Fatalf("expected %q after the header, got %q", rest, b)
+			}
+		})
+	}
+}
+
+func TestParseTLVs(t *testing.T) {
+	cases := []struct {
+		desc string
+		data []byte
+		tlvs []TLV
+		err  error
+	}{
+		{desc: "empty"},
+		{
+			desc: "single",
+			data: tlv(TypeAuthority, "example.com"),
+			tlvs: []TLV{{Type: TypeAuthority, Value: []byte("example.com")}},
+		},
+		{
+			desc: "multiple",
+			data: concat(tlv(TypeALPN, "mqtt"), tlv(TypeNoop, ""), tlv(TypeSubject, "CN=client")),
+			tlvs: []TLV{{Type: TypeALPN, Value: []byte("mqtt")}, {Type: TypeNoop, Value: []byte{}}, {Type: TypeSubject, Value: []byte("CN=client")}},
+		},
+		{desc: "type only", data: []byte{TypeAuthority}, err: ErrInvalidHeader},
+		{desc: "length truncated", data: []byte{TypeAuthority, 0x00}, err: ErrInvalidHeader},
+		{desc: "value truncated", data: tlv(TypeAuthority, "example.com")[:8], err: ErrInvalidHeader},
+		{desc: "second TLV truncated", data: concat(tlv(TypeALPN, "mqtt"), tlv(TypeAuthority, "example.com")[:4]), err: ErrInvalidHeader},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tlvs, err := parseTLVs(tc.data)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if len(tlvs) != len(tc.tlvs) {
+				t.Fatalf("expected %d TLVs, got %d", len(tc.tlvs), len(tlvs))
+			}
+			for i, want := range tc.tlvs {
+				if got := tlvs[i]; got.Type != want.Type || !bytes.Equal(got.Value, want.Value) {
+					t.Fatalf("expected TLV %v, got %v", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSSL(t *testing.T) {
+	want := SSL{Client: ClientSSL | ClientCertConn, Verify: 1, Version: "TLSv1.3", CN: "client"}
+	h := &Header{TLVs: []TLV{NewSSLTLV(want)}}
+	got, ok := h.SSL()
+	if !ok || got != want {
+		t.Fatalf("expected SSL %+v, got %+v", want, got)
+	}
+
+	h = &Header{TLVs: []TLV{{Type: TypeSSL, Value: append(NewSSLTLV(want).Value, TypeSSL)}}}
+	if _, ok := h.SSL(); ok {
+		t.Fatal("expected SSL TLV with truncated subtype to be rejected")
+	}
+}
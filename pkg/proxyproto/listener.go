@@ -0,0 +1,225 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Config is the PROXY protocol configuration of the inbound listener.
+type Config struct {
+	// Enabled requires PROXY protocol header on all the inbound connections.
+	// It must be enabled only if the listener is reachable through the load balancer only.
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Timeout is the maximum time to wait for the header.
+	Timeout time.Duration `env:"TIMEOUT" envDefault:"5s"`
+	// TrustedCIDRs are the networks of the load balancers allowed to send the header.
+	// Connections from the other addresses are closed before the header is read.
+	// If empty, the header is accepted from any address.
+	TrustedCIDRs []netip.Prefix `env:"TRUSTED_CIDRS" envDefault:""`
+}
+
+// trusted reports whether the connection with the given address may send the header.
+func (c Config) trusted(addr net.Addr) bool {
+	if len(c.TrustedCIDRs) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range c.TrustedCIDRs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is the connection with PROXY protocol header. Its remote and local
+// addresses are the ones of the original client connection.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *Header
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the original client address.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Command == Proxy && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the original address the client connected to.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Command == Proxy && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Header returns PROXY protocol header of the connection.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// HeaderFromConn returns PROXY protocol header of the connection, or nil if the connection
+// doesn't have one. Connections wrapping the other ones, such as *tls.Conn, are unwrapped.
+func HeaderFromConn(conn net.Conn) *Header {
+	for conn != nil {
+		if c, ok := conn.(*Conn); ok {
+			return c.header
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = u.NetConn()
+	}
+	return nil
+}
+
+type headerKey struct{}
+
+// NewContext stores PROXY protocol header of the connection in the context.
+// It can be used as http.Server.ConnContext.
+func NewContext(ctx context.Context, conn net.Conn) context.Context {
+	if h := HeaderFromConn(conn); h != nil {
+		return context.WithValue(ctx, headerKey{}, h)
+	}
+	return ctx
+}
+
+// FromContext returns PROXY protocol header stored in the context.
+func FromContext(ctx context.Context) (*Header, bool) {
+	h, ok := ctx.Value(headerKey{}).(*Header)
+	return h, ok
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+type listener struct {
+	net.Listener
+	config  Config
+	logger  *slog.Logger
+	conns   chan accepted
+	done    chan struct{}
+	start   sync.Once
+	closing sync.Once
+}
+
+// NewListener returns a listener that reads PROXY protocol header from the accepted connections,
+// or the inner listener if PROXY protocol is not enabled. Headers are read concurrently, so slow
+// clients don't block the others. Connections without a valid header and the ones from untrusted
+// addresses are closed. It must wrap the inner listener, since the header precedes the TLS
+// handshake, and the inner listener should limit the connections, since each of them is read
+// in its own goroutine.
+func NewListener(inner net.Listener, config Config, logger *slog.Logger) net.Listener {
+	if !config.Enabled {
+		return inner
+	}
+	return &listener{
+		Listener: inner,
+		config:   config,
+		logger:   logger,
+		conns:    make(chan accepted),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection with a valid header.
+func (l *listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.accept()
+	})
+	select {
+	case a := <-l.conns:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closing.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *listener) accept() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.conns <- accepted{err: err}:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.config.trusted(c.RemoteAddr()) {
+			l.logger.Warn("Rejected PROXY protocol connection from untrusted address", slog.String("remote", c.RemoteAddr().String()))
+			c.Close()
+			continue
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *listener) handshake(c net.Conn) {
+	conn, err := l.readHeader(c)
+	if err != nil {
+		l.logger.Warn("Failed to read PROXY protocol header", slog.String("remote", c.RemoteAddr().String()), slog.Any("error", err))
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- accepted{conn: conn}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *listener) readHeader(c net.Conn) (*Conn, error) {
+	if l.config.Timeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(l.config.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	r := bufio.NewReader(c)
+	h, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, r: r, header: h}, nil
+}
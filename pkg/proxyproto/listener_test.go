@@ -0,0 +1,121 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	cases := []struct {
+		desc     string
+		trusted  []netip.Prefix
+		header   string
+		accepted bool
+		// remote is the expected client address, or empty for the address of the connection.
+		remote string
+	}{
+		{
+			desc:     "any source trusted",
+			header:   "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n",
+			accepted: true,
+			remote:   "192.0.2.1:56324",
+		},
+		{
+			desc:     "trusted source",
+			trusted:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("127.0.0.0/8")},
+			header:   "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n",
+			accepted: true,
+			remote:   "192.0.2.1:56324",
+		},
+		{
+			desc:    "untrusted source",
+			trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			header:  "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n",
+		},
+		{
+			desc:   "invalid header",
+			header: "PROXY TCP4 192.0.2.1\r\n",
+		},
+		{
+			desc:     "LOCAL header keeps the connection address",
+			header:   "PROXY UNKNOWN\r\n",
+			accepted: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := Config{Enabled: true, Timeout: time.Second, TrustedCIDRs: tc.trusted}
+			l := NewListener(inner, config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				defer close(accepted)
+				if c, err := l.Accept(); err == nil {
+					accepted <- c
+				}
+			}()
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte(tc.header + "data")); err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.accepted {
+				// The rejected connection is closed, and never accepted.
+				if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				var b [1]byte
+				if _, err := client.Read(b[:]); !closed(err) {
+					t.Fatalf("expected the connection to be closed, got %v", err)
+				}
+				l.Close()
+				if c, ok := <-accepted; ok {
+					t.Fatalf("expected no connection to be accepted, got one from %s", c.RemoteAddr())
+				}
+				return
+			}
+
+			defer l.Close()
+			var c net.Conn
+			select {
+			case c = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the connection to be accepted")
+			}
+			defer c.Close()
+			want := tc.remote
+			if want == "" {
+				want = client.LocalAddr().String()
+			}
+			if got := c.RemoteAddr().String(); got != want {
+				t.Fatalf("expected remote address %s, got %s", want, got)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(c, b); err != nil || string(b) != "data" {
+				t.Fatalf("expected the data after the header, got %q, %v", b, err)
+			}
+		})
+	}
+}
+
+// closed reports whether the error is the one of the connection closed by the peer.
+func closed(err error) bool {
+	var op *net.OpError
+	return errors.Is(err, io.EOF) || errors.As(err, &op) && !op.Timeout()
+}
@@ -0,0 +1,186 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+)
+
+// TypeSubject is the application specific TLV type of the client certificate subject
+// distinguished name, sent by mGate along with the standard SSL TLV.
+const TypeSubject byte = 0xE0
+
+var (
+	errVersion   = "unsupported PROXY protocol version %d"
+	errTLVLength = errors.New("PROXY protocol TLV too long")
+)
+
+// NewHeader returns PROXY protocol header of the given version for the connection from
+// src to dst, or nil if the version is 0. Version 2 header includes the TLVs with the
+// subject of the client certificate, if the certificate is present. The certificate
+// is reported as verified only if it was verified against the client CA pool.
+func NewHeader(version int, src, dst net.Addr, cert x509.Certificate, verified bool) *Header {
+	if version == 0 {
+		return nil
+	}
+	h := &Header{
+		Version:     version,
+		Command:     Proxy,
+		Source:      src,
+		Destination: dst,
+	}
+	if version == 2 && len(cert.Raw) > 0 {
+		ssl := SSL{
+			Client: ClientSSL | ClientCertConn,
+			CN:     cert.Subject.CommonName,
+		}
+		// Zero means the certificate was verified, so any other value is used otherwise.
+		if !verified {
+			ssl.Verify = 1
+		}
+		h.TLVs = []TLV{
+			NewSSLTLV(ssl),
+			{Type: TypeSubject, Value: []byte(cert.Subject.String())},
+		}
+	}
+	return h
+}
+
+// NewLocalHeader returns PROXY protocol header of the given version for the connection
+// opened by mGate itself, such as the health check, or nil if the version is 0.
+func NewLocalHeader(version int) *Header {
+	if version == 0 {
+		return nil
+	}
+	return &Header{
+		Version: version,
+		Command: Local,
+	}
+}
+
+// NewSSLTLV returns the SSL TLV with the given information about the client TLS connection.
+func NewSSLTLV(ssl SSL) TLV {
+	v := make([]byte, 5)
+	v[0] = ssl.Client
+	binary.BigEndian.PutUint32(v[1:], ssl.Verify)
+	for _, sub := range []TLV{
+		{Type: subtypeSSLVersion, Value: []byte(ssl.Version)},
+		{Type: subtypeSSLCN, Value: []byte(ssl.CN)},
+		{Type: subtypeSSLCipher, Value: []byte(ssl.Cipher)},
+		{Type: subtypeSSLSigAlg, Value: []byte(ssl.SigAlg)},
+		{Type: subtypeSSLKeyAlg, Value: []byte(ssl.KeyAlg)},
+	} {
+		if len(sub.Value) > 0 {
+			v = appendTLV(v, sub)
+		}
+	}
+	return TLV{Type: TypeSSL, Value: v}
+}
+
+// WriteTo writes the header to the writer.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// Format returns the header in the wire format of its version.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2()
+	default:
+		return nil, fmt.Errorf(errVersion, h.Version)
+	}
+}
+
+func (h *Header) formatV1() []byte {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	if h.Command != Proxy || !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+	}
+	// Both addresses of TCP6 line must be IPv6, so IPv4 one is sent as IPv4-mapped address.
+	srcIP, srcOK := netip.AddrFromSlice(src.IP.To16())
+	dstIP, dstOK := netip.AddrFromSlice(dst.IP.To16())
+	if !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	return fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port)
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var fam byte
+	var addrs []byte
+	srcIP, srcPort, srcProto := ipPort(h.Source)
+	dstIP, dstPort, dstProto := ipPort(h.Destination)
+	if h.Command == Proxy && srcIP != nil && dstIP != nil && srcProto == dstProto {
+		switch {
+		case srcIP.To4() != nil && dstIP.To4() != nil:
+			fam = famInet<<4 | srcProto
+			addrs = append(addrs, srcIP.To4()...)
+			addrs = append(addrs, dstIP.To4()...)
+		default:
+			fam = famInet6<<4 | srcProto
+			addrs = append(addrs, srcIP.To16()...)
+			addrs = append(addrs, dstIP.To16()...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+	}
+
+	payload := addrs
+	for _, t := range h.TLVs {
+		if len(t.Value) > math.MaxUint16 {
+			return nil, errTLVLength
+		}
+		payload = appendTLV(payload, t)
+	}
+	if len(payload) > math.MaxUint16 {
+		return nil, errTLVLength
+	}
+
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	buf.WriteByte(v2Version | byte(h.Command))
+	buf.WriteByte(fam)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// ipPort returns IP address, port and the transport protocol of the address,
+// which is 0x1 for STREAM and 0x2 for DGRAM.
+func ipPort(addr net.Addr) (net.IP, int, byte) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, 0x1
+	case *net.UDPAddr:
+		return a.IP, a.Port, 0x2
+	default:
+		return nil, 0, 0
+	}
+}
+
+func appendTLV(b []byte, t TLV) []byte {
+	b = append(b, t.Type)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.Value)))
+	return append(b, t.Value...)
+}
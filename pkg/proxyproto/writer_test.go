@@ -0,0 +1,77 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFormatV1(t *testing.T) {
+	tcp := func(ip string, port int) *net.TCPAddr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	cases := []struct {
+		desc   string
+		header *Header
+		want   string
+	}{
+		{
+			desc:   "IPv4",
+			header: &Header{Version: 1, Command: Proxy, Source: tcp("192.0.2.1", 56324), Destination: tcp("192.0.2.2", 1883)},
+			want:   "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n",
+		},
+		{
+			desc:   "IPv6",
+			header: &Header{Version: 1, Command: Proxy, Source: tcp("2001:db8::1", 56324), Destination: tcp("2001:db8::2", 1883)},
+			want:   "PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n",
+		},
+		{
+			desc:   "IPv4 source and IPv6 destination",
+			header: &Header{Version: 1, Command: Proxy, Source: tcp("192.0.2.1", 56324), Destination: tcp("2001:db8::2", 1883)},
+			want:   "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 1883\r\n",
+		},
+		{
+			desc:   "IPv6 source and IPv4 destination",
+			header: &Header{Version: 1, Command: Proxy, Source: tcp("2001:db8::1", 56324), Destination: tcp("192.0.2.2", 1883)},
+			want:   "PROXY TCP6 2001:db8::1 ::ffff:192.0.2.2 56324 1883\r\n",
+		},
+		{
+			desc:   "invalid address",
+			header: &Header{Version: 1, Command: Proxy, Source: &net.TCPAddr{IP: net.IP{1, 2, 3}}, Destination: tcp("2001:db8::2", 1883)},
+			want:   "PROXY UNKNOWN\r\n",
+		},
+		{
+			desc:   "UDP addresses",
+			header: &Header{Version: 1, Command: Proxy, Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, Destination: &net.UDPAddr{IP: net.ParseIP("192.0.2.2")}},
+			want:   "PROXY UNKNOWN\r\n",
+		},
+		{
+			desc:   "LOCAL",
+			header: NewLocalHeader(1),
+			want:   "PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b, err := tc.header.Format()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(b) != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, b)
+			}
+			// The header is read back as sent.
+			h, err := Read(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("unexpected error reading the header: %s", err)
+			}
+			if h.Command == Proxy && (!h.Source.(*net.TCPAddr).IP.Equal(tc.header.Source.(*net.TCPAddr).IP) || !h.Destination.(*net.TCPAddr).IP.Equal(tc.header.Destination.(*net.TCPAddr).IP)) {
+				t.Fatalf("expected addresses %s and %s, got %s and %s", tc.header.Source, tc.header.Destination, h.Source, h.Destination)
+			}
+		})
+	}
+}
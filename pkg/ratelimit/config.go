@@ -0,0 +1,103 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Action defines what happens with the messages over the limit.
+type Action int
+
+const (
+	// Delay holds the message until it conforms to the limit, which applies
+	// backpressure to the client.
+	Delay Action = iota
+	// Drop drops the message.
+	Drop
+	// Disconnect closes the client connection.
+	Disconnect
+)
+
+// Key defines which client attribute the limits are applied to.
+type Key int
+
+const (
+	// ClientID applies limits per client ID.
+	ClientID Key = iota
+	// Username applies limits per username.
+	Username
+	// IP applies limits per client IP address.
+	IP
+)
+
+var (
+	errAction = "unknown rate limit action %q"
+	errKey    = "unknown rate limit key %q"
+)
+
+// Config is the rate limiter configuration.
+type Config struct {
+	// Messages is the number of messages per second. Zero means no limit.
+	Messages float64 `env:"MESSAGES" envDefault:"0"`
+	// Bytes is the number of payload bytes per second. Zero means no limit.
+	Bytes  float64 `env:"BYTES"  envDefault:"0"`
+	Key    Key     `env:"KEY"    envDefault:"client_id"`
+	Action Action  `env:"ACTION" envDefault:"delay"`
+}
+
+func (a Action) String() string {
+	switch a {
+	case Drop:
+		return "drop"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "delay"
+	}
+}
+
+// UnmarshalText parses action from its string representation,
+// so it can be loaded from environment variables.
+func (a *Action) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "delay":
+		*a = Delay
+	case "drop":
+		*a = Drop
+	case "disconnect":
+		*a = Disconnect
+	default:
+		return fmt.Errorf(errAction, text)
+	}
+	return nil
+}
+
+func (k Key) String() string {
+	switch k {
+	case Username:
+		return "username"
+	case IP:
+		return "ip"
+	default:
+		return "client_id"
+	}
+}
+
+// UnmarshalText parses key from its string representation,
+// so it can be loaded from environment variables.
+func (k *Key) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "client_id":
+		*k = ClientID
+	case "username":
+		*k = Username
+	case "ip":
+		*k = IP
+	default:
+		return fmt.Errorf(errKey, text)
+	}
+	return nil
+}
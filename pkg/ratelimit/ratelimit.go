@@ -0,0 +1,217 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ratelimit provides token bucket rate limiting of the messages sent by clients.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// idleTimeout is the time after which buckets of inactive clients are removed.
+const idleTimeout = 10 * time.Minute
+
+var (
+	// ErrDropped indicates the message is over the limit and must be dropped.
+	ErrDropped = errors.New("message dropped by rate limiter")
+
+	// ErrLimitExceeded indicates the message is over the limit and the client must be disconnected.
+	ErrLimitExceeded = errors.New("rate limit exceeded")
+)
+
+// Limit is the rate of messages and payload bytes per second a client may send.
+// Zero values mean no limit. Clients may burst up to one second worth of traffic.
+type Limit struct {
+	Messages float64
+	Bytes    float64
+}
+
+// Unlimited reports whether the limit allows any rate.
+func (l Limit) Unlimited() bool {
+	return l.Messages <= 0 && l.Bytes <= 0
+}
+
+// Limiter applies limits to the clients. It is safe for concurrent use.
+// All the methods are safe to call on nil Limiter, which does not limit anything.
+type Limiter struct {
+	config Config
+
+	mu      sync.Mutex
+	clients map[string]*client
+	swept   time.Time
+}
+
+type client struct {
+	messages bucket
+	bytes    bucket
+	used     time.Time
+}
+
+// New returns a new rate limiter.
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:  config,
+		clients: make(map[string]*client),
+		swept:   time.Now(),
+	}
+}
+
+// Limit returns the default limit, which can be adjusted per session.
+func (l *Limiter) Limit() Limit {
+	if l == nil {
+		return Limit{}
+	}
+	return Limit{Messages: l.config.Messages, Bytes: l.config.Bytes}
+}
+
+// Action returns the action applied to the messages over the limit.
+func (l *Limiter) Action() Action {
+	if l == nil {
+		return Delay
+	}
+	return l.config.Action
+}
+
+// Key returns the key the client is limited by. If the configured client
+// attribute is not known, the client is limited by its IP address.
+func (l *Limiter) Key(clientID, username, remoteAddr string) string {
+	if l == nil {
+		return ""
+	}
+	switch {
+	case l.config.Key == ClientID && clientID != "":
+		return "client_id:" + clientID
+	case l.config.Key == Username && username != "":
+		return "username:" + username
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// Wait applies the limit to the message of the given payload size sent by the client with the given key.
+// With Delay action, it blocks until the message conforms to the limit. With Drop and Disconnect
+// actions, it returns ErrDropped or ErrLimitExceeded respectively if the message is over the limit.
+func (l *Limiter) Wait(ctx context.Context, key string, limit Limit, size int) error {
+	if l == nil {
+		return nil
+	}
+	wait, err := l.take(key, limit, size, l.config.Action)
+	if err != nil || wait == 0 {
+		return err
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Allow is the same as Wait, but it never blocks. With Delay action,
+// messages over the limit are dropped, so it can be used by the proxies
+// that can't hold messages of a single client.
+func (l *Limiter) Allow(key string, limit Limit, size int) error {
+	if l == nil {
+		return nil
+	}
+	action := l.config.Action
+	if action == Delay {
+		action = Drop
+	}
+	_, err := l.take(key, limit, size, action)
+	return err
+}
+
+// take takes the message from the client buckets and returns how long it needs to be delayed.
+func (l *Limiter) take(key string, limit Limit, size int, action Action) (time.Duration, error) {
+	if limit.Unlimited() {
+		return 0, nil
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key, now)
+	c.messages.refill(limit.Messages, now)
+	c.bytes.refill(limit.Bytes, now)
+	if action != Delay && !(c.messages.conforms(1) && c.bytes.conforms(float64(size))) {
+		if action == Drop {
+			return 0, ErrDropped
+		}
+		return 0, ErrLimitExceeded
+	}
+	return max(c.messages.take(1), c.bytes.take(float64(size))), nil
+}
+
+// client returns the buckets of the client and removes buckets of inactive clients.
+func (l *Limiter) client(key string, now time.Time) *client {
+	if now.Sub(l.swept) > idleTimeout {
+		for k, c := range l.clients {
+			if now.Sub(c.used) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{}
+		l.clients[key] = c
+	}
+	c.used = now
+	return c
+}
+
+// bucket is a token bucket with the capacity of one second worth of tokens.
+// Tokens may go below zero when the message is reserved in advance.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds tokens accumulated since the last use. The bucket is full
+// when used for the first time. When the rate is changed, the tokens are
+// scaled to the new capacity, so the client can't reset its bucket to full
+// by alternating between the sessions with different limits.
+func (b *bucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() || b.rate <= 0 {
+		b.rate = rate
+		b.tokens = rate
+		b.last = now
+		return
+	}
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if rate != b.rate {
+		b.tokens *= rate / b.rate
+		b.rate = rate
+	}
+}
+
+// conforms reports whether n tokens can be taken right away.
+// Messages larger than the bucket capacity conform once the bucket is full.
+func (b *bucket) conforms(n float64) bool {
+	return b.rate <= 0 || b.tokens >= min(n, b.rate)
+}
+
+// take takes n tokens and returns the time until the bucket is out of debt.
+func (b *bucket) take(n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
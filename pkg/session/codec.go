@@ -0,0 +1,397 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/eclipse/paho.golang/packets"
+	mqttv3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// MQTT protocol levels as sent in the CONNECT packet.
+const (
+	V31  byte = 3
+	V311 byte = 4
+	V5   byte = 5
+)
+
+const maxVBILen = 4
+
+var (
+	errMalformedLength    = errors.New("malformed remaining length")
+	errFirstNotConnect    = errors.New("first packet is not CONNECT")
+	errMalformedConnect   = errors.New("malformed CONNECT packet")
+	errUnknownPacket      = errors.New("unknown packet type")
+	errUnsupportedVersion = "unsupported MQTT protocol version %d"
+	errUnsupportedPacket  = "packet %s is not supported by MQTT protocol version %d"
+)
+
+// codec reads and writes MQTT control packets in the wire format of a single
+// protocol version. Regardless of the version, packets are represented using
+// MQTT 5.0 structures, so the rest of the session does not need to care about
+// the version. Encoding for older versions drops properties and maps reason
+// codes to the closest return code.
+type codec interface {
+	// read reads the next packet. Packets larger than maxSize are rejected
+	// before their payload is read. Zero maxSize means no limit.
+	read(r io.Reader, maxSize int) (*packets.ControlPacket, error)
+	write(w io.Writer, pkt *packets.ControlPacket) error
+	version() byte
+}
+
+// newCodec returns the codec for the given protocol level.
+func newCodec(version byte) (codec, error) {
+	switch version {
+	case V31, V311:
+		return v3Codec{level: version}, nil
+	case V5:
+		return v5Codec{}, nil
+	default:
+		return nil, fmt.Errorf(errUnsupportedVersion, version)
+	}
+}
+
+// readFrame reads a single MQTT control packet, fixed header included, and returns its raw bytes.
+// The size of the packet is checked against maxSize before the rest of the packet is read.
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	frame := []byte{b[0]}
+	length, mul := 0, 1
+	for i := 0; ; i++ {
+		if i == maxVBILen {
+			return nil, errMalformedLength
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		frame = append(frame, b[0])
+		length += int(b[0]&0x7f) * mul
+		if b[0]&0x80 == 0 {
+			break
+		}
+		mul *= 128
+	}
+	hdrLen := len(frame)
+	if maxSize > 0 && hdrLen+length > maxSize {
+		return nil, errPacketTooLarge
+	}
+	frame = append(frame, make([]byte, length)...)
+	if _, err := io.ReadFull(r, frame[hdrLen:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// protocolVersion returns the protocol level of the raw CONNECT packet.
+func protocolVersion(frame []byte) (byte, error) {
+	if len(frame) == 0 || frame[0]>>4 != packets.CONNECT {
+		return 0, errFirstNotConnect
+	}
+	// Skip the fixed header.
+	i := 1
+	for i < len(frame) && frame[i]&0x80 != 0 {
+		i++
+	}
+	i++
+	if i+2 > len(frame) {
+		return 0, errMalformedConnect
+	}
+	nameLen := int(frame[i])<<8 | int(frame[i+1])
+	i += 2 + nameLen
+	if i >= len(frame) {
+		return 0, errMalformedConnect
+	}
+	return frame[i], nil
+}
+
+type v5Codec struct{}
+
+func (v5Codec) read(r io.Reader, maxSize int) (*packets.ControlPacket, error) {
+	frame, err := readFrame(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	// A DISCONNECT with no variable header means normal disconnection,
+	// but the paho decoder expects at least the reason code.
+	if frame[0]>>4 == packets.DISCONNECT && len(frame) == 2 {
+		return packets.NewControlPacket(packets.DISCONNECT), nil
+	}
+	return packets.ReadPacket(bytes.NewReader(frame))
+}
+
+func (v5Codec) write(w io.Writer, pkt *packets.ControlPacket) error {
+	// Encode the packet into a single buffer so it is written in one call.
+	// This keeps MQTT over WebSocket packets in a single WebSocket message.
+	var buf bytes.Buffer
+	if _, err := pkt.WriteTo(&buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (v5Codec) version() byte {
+	return V5
+}
+
+type v3Codec struct {
+	level byte
+}
+
+func (c v3Codec) read(r io.Reader, maxSize int) (*packets.ControlPacket, error) {
+	frame, err := readFrame(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := mqttv3.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	return fromV3(pkt)
+}
+
+func (c v3Codec) write(w io.Writer, pkt *packets.ControlPacket) error {
+	p, err := c.toV3(pkt)
+	if err != nil {
+		return err
+	}
+	return p.Write(w)
+}
+
+func (c v3Codec) version() byte {
+	return c.level
+}
+
+// fromV3 converts MQTT 3.1.1 packet to its MQTT 5.0 representation.
+func fromV3(pkt mqttv3.ControlPacket) (*packets.ControlPacket, error) {
+	switch p := pkt.(type) {
+	case *mqttv3.ConnectPacket:
+		cp := packets.NewControlPacket(packets.CONNECT)
+		c := cp.Content.(*packets.Connect)
+		c.ProtocolName = p.ProtocolName
+		c.ProtocolVersion = p.ProtocolVersion
+		c.CleanStart = p.CleanSession
+		c.WillFlag = p.WillFlag
+		c.WillQOS = p.WillQos
+		c.WillRetain = p.WillRetain
+		c.UsernameFlag = p.UsernameFlag
+		c.PasswordFlag = p.PasswordFlag
+		c.KeepAlive = p.Keepalive
+		c.ClientID = p.ClientIdentifier
+		c.WillTopic = p.WillTopic
+		c.WillMessage = p.WillMessage
+		c.Username = p.Username
+		c.Password = p.Password
+		if p.WillFlag {
+			c.WillProperties = &packets.Properties{}
+		}
+		return cp, nil
+	case *mqttv3.ConnackPacket:
+		cp := packets.NewControlPacket(packets.CONNACK)
+		c := cp.Content.(*packets.Connack)
+		c.SessionPresent = p.SessionPresent
+		c.ReasonCode = connackFromV3(p.ReturnCode)
+		return cp, nil
+	case *mqttv3.PublishPacket:
+		cp := packets.NewControlPacket(packets.PUBLISH)
+		c := cp.Content.(*packets.Publish)
+		c.Topic = p.TopicName
+		c.Payload = p.Payload
+		c.PacketID = p.MessageID
+		c.QoS = p.Qos
+		c.Duplicate = p.Dup
+		c.Retain = p.Retain
+		return cp, nil
+	case *mqttv3.PubackPacket:
+		cp := packets.NewControlPacket(packets.PUBACK)
+		cp.Content.(*packets.Puback).PacketID = p.MessageID
+		return cp, nil
+	case *mqttv3.PubrecPacket:
+		cp := packets.NewControlPacket(packets.PUBREC)
+		cp.Content.(*packets.Pubrec).PacketID = p.MessageID
+		return cp, nil
+	case *mqttv3.PubrelPacket:
+		cp := packets.NewControlPacket(packets.PUBREL)
+		cp.Content.(*packets.Pubrel).PacketID = p.MessageID
+		return cp, nil
+	case *mqttv3.PubcompPacket:
+		cp := packets.NewControlPacket(packets.PUBCOMP)
+		cp.Content.(*packets.Pubcomp).PacketID = p.MessageID
+		return cp, nil
+	case *mqttv3.SubscribePacket:
+		cp := packets.NewControlPacket(packets.SUBSCRIBE)
+		c := cp.Content.(*packets.Subscribe)
+		c.PacketID = p.MessageID
+		for i, topic := range p.Topics {
+			opts := packets.SubOptions{Topic: topic}
+			if i < len(p.Qoss) {
+				opts.QoS = p.Qoss[i]
+			}
+			c.Subscriptions = append(c.Subscriptions, opts)
+		}
+		return cp, nil
+	case *mqttv3.SubackPacket:
+		cp := packets.NewControlPacket(packets.SUBACK)
+		c := cp.Content.(*packets.Suback)
+		c.PacketID = p.MessageID
+		c.Reasons = p.ReturnCodes
+		return cp, nil
+	case *mqttv3.UnsubscribePacket:
+		cp := packets.NewControlPacket(packets.UNSUBSCRIBE)
+		c := cp.Content.(*packets.Unsubscribe)
+		c.PacketID = p.MessageID
+		c.Topics = p.Topics
+		return cp, nil
+	case *mqttv3.UnsubackPacket:
+		cp := packets.NewControlPacket(packets.UNSUBACK)
+		cp.Content.(*packets.Unsuback).PacketID = p.MessageID
+		return cp, nil
+	case *mqttv3.PingreqPacket:
+		return packets.NewControlPacket(packets.PINGREQ), nil
+	case *mqttv3.PingrespPacket:
+		return packets.NewControlPacket(packets.PINGRESP), nil
+	case *mqttv3.DisconnectPacket:
+		return packets.NewControlPacket(packets.DISCONNECT), nil
+	default:
+		return nil, errUnknownPacket
+	}
+}
+
+// toV3 converts MQTT 5.0 packet representation to MQTT 3.1.1 packet.
+func (c v3Codec) toV3(pkt *packets.ControlPacket) (mqttv3.ControlPacket, error) {
+	switch p := pkt.Content.(type) {
+	case *packets.Connect:
+		cp := mqttv3.NewControlPacket(mqttv3.Connect).(*mqttv3.ConnectPacket)
+		cp.ProtocolName = p.ProtocolName
+		cp.ProtocolVersion = p.ProtocolVersion
+		cp.CleanSession = p.CleanStart
+		cp.WillFlag = p.WillFlag
+		cp.WillQos = p.WillQOS
+		cp.WillRetain = p.WillRetain
+		cp.UsernameFlag = p.UsernameFlag
+		cp.PasswordFlag = p.PasswordFlag
+		cp.Keepalive = p.KeepAlive
+		cp.ClientIdentifier = p.ClientID
+		cp.WillTopic = p.WillTopic
+		cp.WillMessage = p.WillMessage
+		cp.Username = p.Username
+		cp.Password = p.Password
+		return cp, nil
+	case *packets.Connack:
+		cp := mqttv3.NewControlPacket(mqttv3.Connack).(*mqttv3.ConnackPacket)
+		cp.SessionPresent = p.SessionPresent
+		cp.ReturnCode = connackToV3(p.ReasonCode)
+		return cp, nil
+	case *packets.Publish:
+		cp := mqttv3.NewControlPacket(mqttv3.Publish).(*mqttv3.PublishPacket)
+		cp.TopicName = p.Topic
+		cp.Payload = p.Payload
+		cp.MessageID = p.PacketID
+		cp.Qos = p.QoS
+		cp.Dup = p.Duplicate
+		cp.Retain = p.Retain
+		return cp, nil
+	case *packets.Puback:
+		cp := mqttv3.NewControlPacket(mqttv3.Puback).(*mqttv3.PubackPacket)
+		cp.MessageID = p.PacketID
+		return cp, nil
+	case *packets.Pubrec:
+		cp := mqttv3.NewControlPacket(mqttv3.Pubrec).(*mqttv3.PubrecPacket)
+		cp.MessageID = p.PacketID
+		return cp, nil
+	case *packets.Pubrel:
+		cp := mqttv3.NewControlPacket(mqttv3.Pubrel).(*mqttv3.PubrelPacket)
+		cp.MessageID = p.PacketID
+		return cp, nil
+	case *packets.Pubcomp:
+		cp := mqttv3.NewControlPacket(mqttv3.Pubcomp).(*mqttv3.PubcompPacket)
+		cp.MessageID = p.PacketID
+		return cp, nil
+	case *packets.Subscribe:
+		cp := mqttv3.NewControlPacket(mqttv3.Subscribe).(*mqttv3.SubscribePacket)
+		cp.MessageID = p.PacketID
+		for _, s := range p.Subscriptions {
+			cp.Topics = append(cp.Topics, s.Topic)
+			cp.Qoss = append(cp.Qoss, s.QoS)
+		}
+		return cp, nil
+	case *packets.Suback:
+		cp := mqttv3.NewControlPacket(mqttv3.Suback).(*mqttv3.SubackPacket)
+		cp.MessageID = p.PacketID
+		for _, r := range p.Reasons {
+			cp.ReturnCodes = append(cp.ReturnCodes, subackToV3(r))
+		}
+		return cp, nil
+	case *packets.Unsubscribe:
+		cp := mqttv3.NewControlPacket(mqttv3.Unsubscribe).(*mqttv3.UnsubscribePacket)
+		cp.MessageID = p.PacketID
+		cp.Topics = p.Topics
+		return cp, nil
+	case *packets.Unsuback:
+		cp := mqttv3.NewControlPacket(mqttv3.Unsuback).(*mqttv3.UnsubackPacket)
+		cp.MessageID = p.PacketID
+		return cp, nil
+	case *packets.Pingreq:
+		return mqttv3.NewControlPacket(mqttv3.Pingreq), nil
+	case *packets.Pingresp:
+		return mqttv3.NewControlPacket(mqttv3.Pingresp), nil
+	case *packets.Disconnect:
+		return mqttv3.NewControlPacket(mqttv3.Disconnect), nil
+	default:
+		return nil, fmt.Errorf(errUnsupportedPacket, pkt.PacketType(), c.level)
+	}
+}
+
+// connackFromV3 maps MQTT 3.1.1 CONNACK return code to MQTT 5.0 reason code.
+func connackFromV3(code byte) byte {
+	switch code {
+	case mqttv3.Accepted:
+		return packets.ConnackSuccess
+	case mqttv3.ErrRefusedBadProtocolVersion:
+		return packets.ConnackUnsupportedProtocolVersion
+	case mqttv3.ErrRefusedIDRejected:
+		return packets.ConnackInvalidClientID
+	case mqttv3.ErrRefusedServerUnavailable:
+		return packets.ConnackServerUnavailable
+	case mqttv3.ErrRefusedBadUsernameOrPassword:
+		return packets.ConnackBadUsernameOrPassword
+	case mqttv3.ErrRefusedNotAuthorised:
+		return packets.ConnackNotAuthorized
+	default:
+		return packets.ConnackUnspecifiedError
+	}
+}
+
+// connackToV3 maps MQTT 5.0 CONNACK reason code to the closest MQTT 3.1.1 return code.
+func connackToV3(code byte) byte {
+	switch code {
+	case packets.ConnackSuccess:
+		return mqttv3.Accepted
+	case packets.ConnackUnsupportedProtocolVersion:
+		return mqttv3.ErrRefusedBadProtocolVersion
+	case packets.ConnackInvalidClientID:
+		return mqttv3.ErrRefusedIDRejected
+	case packets.ConnackServerUnavailable, packets.ConnackServerBusy, packets.ConnackUseAnotherServer, packets.ConnackServerMoved:
+		return mqttv3.ErrRefusedServerUnavailable
+	case packets.ConnackBadUsernameOrPassword, packets.ConnackBadAuthenticationMethod:
+		return mqttv3.ErrRefusedBadUsernameOrPassword
+	default:
+		return mqttv3.ErrRefusedNotAuthorised
+	}
+}
+
+// subackToV3 maps MQTT 5.0 SUBACK reason code to MQTT 3.1.1 return code.
+func subackToV3(code byte) byte {
+	if code >= packets.SubackUnspecifiederror {
+		return packets.SubackUnspecifiederror
+	}
+	return code
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+// Delivery describes the acknowledged delivery of QoS 1 or QoS 2 PUBLISH packet.
+type Delivery struct {
+	// Direction is the direction of the PUBLISH packet: Up for messages
+	// published by the client and Down for messages sent to the client.
+	Direction Direction
+	PacketID  uint16
+	Topic     string
+	QoS       byte
+	// ReasonCode is the MQTT 5.0 reason code of the acknowledgement.
+	// Reason codes of 0x80 and above mean the message was not accepted.
+	// It is always 0 for MQTT 3.1.1 sessions.
+	ReasonCode byte
+	// Latency is the time between forwarding the PUBLISH and receiving the final acknowledgement.
+	Latency time.Duration
+}
+
+// DeliveryHandler is an optional extension of the Handler.
+// If the Handler implements it, it is notified about acknowledged messages.
+type DeliveryHandler interface {
+	// Delivered is called once QoS 1 message is acknowledged with PUBACK,
+	// QoS 2 message with PUBCOMP, or QoS 2 message is rejected with PUBREC.
+	Delivered(ctx context.Context, d Delivery) error
+}
+
+type inflight struct {
+	topic string
+	qos   byte
+	sent  time.Time
+}
+
+// deliveries correlates acknowledgements with the PUBLISH packets they acknowledge.
+type deliveries struct {
+	mu       sync.Mutex
+	inflight map[Direction]map[uint16]inflight
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{
+		inflight: map[Direction]map[uint16]inflight{
+			Up:   make(map[uint16]inflight),
+			Down: make(map[uint16]inflight),
+		},
+	}
+}
+
+// sent records QoS 1 and QoS 2 PUBLISH packets forwarded in the given direction.
+func (d *deliveries) sent(dir Direction, p *packets.Publish) {
+	if p.QoS == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Keep the original send time for retransmitted packets.
+	if _, ok := d.inflight[dir][p.PacketID]; ok && p.Duplicate {
+		return
+	}
+	d.inflight[dir][p.PacketID] = inflight{topic: p.Topic, qos: p.QoS, sent: time.Now()}
+}
+
+// acked returns the delivery completed by the acknowledgement forwarded in the given direction.
+// The acknowledgement completes the delivery of the PUBLISH sent in the opposite direction.
+func (d *deliveries) acked(dir Direction, pkt *packets.ControlPacket) (Delivery, bool) {
+	var reason byte
+	switch p := pkt.Content.(type) {
+	case *packets.Puback:
+		reason = p.ReasonCode
+	case *packets.Pubrec:
+		// Successful PUBREC is only an intermediate step of QoS 2 flow.
+		if p.ReasonCode < packets.PubrecUnspecifiedError {
+			return Delivery{}, false
+		}
+		reason = p.ReasonCode
+	case *packets.Pubcomp:
+		reason = p.ReasonCode
+	default:
+		return Delivery{}, false
+	}
+
+	pubDir := Up
+	if dir == Up {
+		pubDir = Down
+	}
+	id := pkt.PacketID()
+
+	d.mu.Lock()
+	m, ok := d.inflight[pubDir][id]
+	delete(d.inflight[pubDir], id)
+	d.mu.Unlock()
+	if !ok {
+		return Delivery{}, false
+	}
+	return Delivery{
+		Direction:  pubDir,
+		PacketID:   id,
+		Topic:      m.topic,
+		QoS:        m.qos,
+		ReasonCode: reason,
+		Latency:    time.Since(m.sent),
+	}, true
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"net"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+var (
+	// ErrConnectTimeout indicates the client did not send CONNECT in time.
+	ErrConnectTimeout = errors.New("timed out waiting for CONNECT")
+
+	// ErrKeepAliveTimeout indicates the client did not send any packet within 1.5 times the keep alive period.
+	ErrKeepAliveTimeout = errors.New("client keep alive timed out")
+
+	// ErrIdleTimeout indicates the broker did not send any packet within the idle timeout.
+	ErrIdleTimeout = errors.New("broker connection idle timed out")
+
+	// ErrPacketTooLarge indicates the client sent a packet larger than the maximum packet size.
+	ErrPacketTooLarge = errors.New("packet exceeds maximum packet size")
+
+	// ErrTopicTooLong indicates the client sent a topic longer than the maximum topic length.
+	ErrTopicTooLong = errors.New("topic exceeds maximum topic length")
+
+	// ErrTooManyTopics indicates the client subscribed to more topic filters than allowed in a single SUBSCRIBE.
+	ErrTooManyTopics = errors.New("number of topic filters exceeds the limit")
+
+	// ErrShuttingDown indicates the proxy is shutting down and does not accept new sessions.
+	ErrShuttingDown = errors.New("server shutting down")
+
+	errPacketTooLarge = NewMQTTProxyError(packets.DisconnectPacketTooLarge, ErrPacketTooLarge)
+)
+
+type mqttProxyError struct {
+	reasonCode byte
+	err        error
+}
+
+// MQTTProxyError is an error that carries MQTT 5.0 reason code to be sent to the client.
+// For MQTT 3.1.1 clients, the reason code is mapped to the closest return code.
+type MQTTProxyError interface {
+	error
+	ReasonCode() byte
+}
+
+var _ MQTTProxyError = (*mqttProxyError)(nil)
+
+func (mpe *mqttProxyError) Error() string {
+	return mpe.err.Error()
+}
+
+func (mpe *mqttProxyError) Unwrap() error {
+	return mpe.err
+}
+
+func (mpe *mqttProxyError) ReasonCode() byte {
+	return mpe.reasonCode
+}
+
+// NewMQTTProxyError returns an error with the given MQTT 5.0 reason code,
+// such as packets.ConnackBadUsernameOrPassword or packets.ConnackServerUnavailable.
+func NewMQTTProxyError(reasonCode byte, err error) MQTTProxyError {
+	return &mqttProxyError{reasonCode: reasonCode, err: err}
+}
+
+// reasonCode returns the reason code carried by the error or the default one.
+func reasonCode(err error, defReasonCode byte) byte {
+	var mpe MQTTProxyError
+	if errors.As(err, &mpe) {
+		return mpe.ReasonCode()
+	}
+	return defReasonCode
+}
+
+type subscribeError struct {
+	errs []error
+}
+
+// SubscribeError is an error Handler.AuthSubscribe can return to deny
+// individual topic filters of a SUBSCRIBE packet instead of the whole packet.
+// Allowed topics are forwarded to the broker, and the client receives SUBACK
+// with a failure reason code for each of the denied topics.
+type SubscribeError interface {
+	error
+	// Errors returns authorization result for each of the topics, in the
+	// order of the topics passed to AuthSubscribe. A nil error means the topic is allowed.
+	// The reason code of the MQTTProxyError is used as SUBACK reason code.
+	Errors() []error
+}
+
+var _ SubscribeError = (*subscribeError)(nil)
+
+func (se *subscribeError) Error() string {
+	if err := errors.Join(se.errs...); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func (se *subscribeError) Errors() []error {
+	return se.errs
+}
+
+// NewSubscribeError returns an error with authorization results for each of the subscription topics.
+func NewSubscribeError(errs []error) SubscribeError {
+	return &subscribeError{errs: errs}
+}
+
+// timeoutError replaces read deadline errors with the timeout that caused them.
+func timeoutError(err, timeout error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return timeout
+	}
+	return err
+}
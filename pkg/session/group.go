@@ -0,0 +1,138 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Group tracks the sessions open in a proxy, so they can be closed gracefully
+// when the proxy shuts down. All the methods are safe to call on nil Group,
+// and Join returns nil Member in that case.
+type Group struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	members map[*Member]struct{}
+}
+
+// NewGroup returns an empty session group.
+func NewGroup() *Group {
+	return &Group{
+		members: make(map[*Member]struct{}),
+	}
+}
+
+// Member is a session in the Group.
+// All the methods are safe to call on nil Member.
+type Member struct {
+	group    *Group
+	mu       sync.Mutex
+	closing  bool
+	shutdown func() error
+}
+
+// Join adds a new session to the group. It returns ErrShuttingDown
+// if the group is shutting down and the session must not be started.
+func (g *Group) Join() (*Member, error) {
+	if g == nil {
+		return nil, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil, ErrShuttingDown
+	}
+	m := &Member{group: g}
+	g.members[m] = struct{}{}
+	g.wg.Add(1)
+	return m, nil
+}
+
+// Shutdown stops the group from accepting new sessions, closes the open ones
+// with the functions set by Member.OnShutdown, and waits until all of them leave
+// the group or the context is done.
+func (g *Group) Shutdown(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	g.closed = true
+	members := make([]*Member, 0, len(g.members))
+	for m := range g.members {
+		members = append(members, m)
+	}
+	g.mu.Unlock()
+
+	var errs []error
+	for _, m := range members {
+		errs = append(errs, m.close())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return errors.Join(errs...)
+	case <-ctx.Done():
+		return errors.Join(append(errs, ctx.Err())...)
+	}
+}
+
+// Len returns the number of the open sessions.
+func (g *Group) Len() int {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+// OnShutdown sets the function used to close the session gracefully when
+// the group shuts down. If the group is shutting down already, it is called
+// right away.
+func (m *Member) OnShutdown(f func() error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.shutdown = f
+	closing := m.closing
+	m.mu.Unlock()
+	if closing && f != nil {
+		_ = f()
+	}
+}
+
+// Leave removes the closed session from the group. It must be called once
+// the session is closed and its Disconnect hook returned.
+func (m *Member) Leave() {
+	if m == nil {
+		return
+	}
+	m.group.mu.Lock()
+	defer m.group.mu.Unlock()
+	if _, ok := m.group.members[m]; !ok {
+		return
+	}
+	delete(m.group.members, m)
+	m.group.wg.Done()
+}
+
+func (m *Member) close() error {
+	m.mu.Lock()
+	m.closing = true
+	f := m.shutdown
+	m.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f()
+}
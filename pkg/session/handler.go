@@ -13,10 +13,13 @@ type Handler interface {
 
 	// Authorization on client `PUBLISH`
 	// Topic is passed by reference, so that it can be modified
+	// QoS and retain flag can be changed through the Message from the context
 	AuthPublish(ctx context.Context, topic *string, payload *[]byte) error
 
 	// Authorization on client `SUBSCRIBE`
 	// Topics are passed by reference, so that they can be modified
+	// Denied topics are reported to the client in `SUBACK`; return SubscribeError
+	// to deny only some of the topics and forward the rest to the broker
 	AuthSubscribe(ctx context.Context, topics *[]string) error
 
 	// After client successfully connected
@@ -34,3 +37,12 @@ type Handler interface {
 	// Disconnect on connection with client lost
 	Disconnect(ctx context.Context) error
 }
+
+// WillHandler is an optional extension of the Handler.
+// If the Handler implements it, it is used to authorize the Will message
+// of the client `CONNECT` instead of Handler.AuthPublish.
+type WillHandler interface {
+	// Authorization of the Will message on client `CONNECT`
+	// Topic and payload are passed by reference, so that they can be modified
+	AuthWill(ctx context.Context, topic *string, payload *[]byte) error
+}
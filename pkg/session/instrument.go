@@ -0,0 +1,141 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/tracing"
+)
+
+// Names of the hooks in the metrics and the spans.
+const (
+	hookAuthConnect   = "auth_connect"
+	hookAuthPublish   = "auth_publish"
+	hookAuthSubscribe = "auth_subscribe"
+	hookAuthWill      = "auth_will"
+	hookConnect       = "connect"
+	hookPublish       = "publish"
+	hookSubscribe     = "subscribe"
+	hookUnsubscribe   = "unsubscribe"
+	hookDisconnect    = "disconnect"
+	hookDelivered     = "delivered"
+)
+
+// InstrumentHandler returns the handler that calls each hook of h in its own span, and
+// records the latency and the errors of the hooks if the recorder is not nil. The returned
+// handler implements WillHandler and DeliveryHandler only if h does, so it can be used in
+// place of h.
+func InstrumentHandler(h Handler, r *metrics.Recorder) Handler {
+	ih := instrumented{h: h, r: r}
+	wh, will := h.(WillHandler)
+	dh, delivery := h.(DeliveryHandler)
+	switch {
+	case will && delivery:
+		return struct {
+			instrumented
+			instrumentedWill
+			instrumentedDelivery
+		}{ih, instrumentedWill{wh, r}, instrumentedDelivery{dh, r}}
+	case will:
+		return struct {
+			instrumented
+			instrumentedWill
+		}{ih, instrumentedWill{wh, r}}
+	case delivery:
+		return struct {
+			instrumented
+			instrumentedDelivery
+		}{ih, instrumentedDelivery{dh, r}}
+	default:
+		return ih
+	}
+}
+
+type instrumented struct {
+	h Handler
+	r *metrics.Recorder
+}
+
+func (i instrumented) AuthConnect(ctx context.Context) error {
+	return observe(ctx, i.r, hookAuthConnect, func(ctx context.Context) error {
+		return i.h.AuthConnect(ctx)
+	})
+}
+
+func (i instrumented) AuthPublish(ctx context.Context, topic *string, payload *[]byte) error {
+	return observe(ctx, i.r, hookAuthPublish, func(ctx context.Context) error {
+		return i.h.AuthPublish(ctx, topic, payload)
+	})
+}
+
+func (i instrumented) AuthSubscribe(ctx context.Context, topics *[]string) error {
+	return observe(ctx, i.r, hookAuthSubscribe, func(ctx context.Context) error {
+		return i.h.AuthSubscribe(ctx, topics)
+	})
+}
+
+func (i instrumented) Connect(ctx context.Context) error {
+	return observe(ctx, i.r, hookConnect, func(ctx context.Context) error {
+		return i.h.Connect(ctx)
+	})
+}
+
+func (i instrumented) Publish(ctx context.Context, topic *string, payload *[]byte) error {
+	return observe(ctx, i.r, hookPublish, func(ctx context.Context) error {
+		return i.h.Publish(ctx, topic, payload)
+	})
+}
+
+func (i instrumented) Subscribe(ctx context.Context, topics *[]string) error {
+	return observe(ctx, i.r, hookSubscribe, func(ctx context.Context) error {
+		return i.h.Subscribe(ctx, topics)
+	})
+}
+
+func (i instrumented) Unsubscribe(ctx context.Context, topics *[]string) error {
+	return observe(ctx, i.r, hookUnsubscribe, func(ctx context.Context) error {
+		return i.h.Unsubscribe(ctx, topics)
+	})
+}
+
+func (i instrumented) Disconnect(ctx context.Context) error {
+	return observe(ctx, i.r, hookDisconnect, func(ctx context.Context) error {
+		return i.h.Disconnect(ctx)
+	})
+}
+
+type instrumentedWill struct {
+	h WillHandler
+	r *metrics.Recorder
+}
+
+func (i instrumentedWill) AuthWill(ctx context.Context, topic *string, payload *[]byte) error {
+	return observe(ctx, i.r, hookAuthWill, func(ctx context.Context) error {
+		return i.h.AuthWill(ctx, topic, payload)
+	})
+}
+
+type instrumentedDelivery struct {
+	h DeliveryHandler
+	r *metrics.Recorder
+}
+
+func (i instrumentedDelivery) Delivered(ctx context.Context, d Delivery) error {
+	return observe(ctx, i.r, hookDelivered, func(ctx context.Context) error {
+		return i.h.Delivered(ctx, d)
+	})
+}
+
+// observe calls the hook in its span, and records its latency and error.
+func observe(ctx context.Context, r *metrics.Recorder, hook string, call func(context.Context) error) error {
+	ctx, span := tracing.Start(ctx, hook)
+	start := time.Now()
+	err := call(ctx)
+	r.Hook(hook, start, err)
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import "github.com/eclipse/paho.golang/packets"
+
+// Limits restricts the packets sent by the client. Zero values mean no limit.
+type Limits struct {
+	// MaxPacketSize is the maximum size of a packet in bytes, fixed header included.
+	MaxPacketSize int
+	// MaxTopicLength is the maximum length of topic names and topic filters in bytes.
+	MaxTopicLength int
+	// MaxSubscribeTopics is the maximum number of topic filters in a single SUBSCRIBE.
+	MaxSubscribeTopics int
+}
+
+// check returns MQTTProxyError with the DISCONNECT reason code if the packet exceeds the limits.
+func (l Limits) check(pkt *packets.ControlPacket) error {
+	switch p := pkt.Content.(type) {
+	case *packets.Publish:
+		if l.TopicTooLong(p.Topic) {
+			return NewMQTTProxyError(packets.DisconnectTopicNameInvalid, ErrTopicTooLong)
+		}
+	case *packets.Subscribe:
+		if l.MaxSubscribeTopics > 0 && len(p.Subscriptions) > l.MaxSubscribeTopics {
+			return NewMQTTProxyError(packets.DisconnectQuotaExceeded, ErrTooManyTopics)
+		}
+		for _, s := range p.Subscriptions {
+			if l.TopicTooLong(s.Topic) {
+				return NewMQTTProxyError(packets.DisconnectTopicFilterInvalid, ErrTopicTooLong)
+			}
+		}
+	case *packets.Unsubscribe:
+		for _, t := range p.Topics {
+			if l.TopicTooLong(t) {
+				return NewMQTTProxyError(packets.DisconnectTopicFilterInvalid, ErrTopicTooLong)
+			}
+		}
+	}
+	return nil
+}
+
+// TopicTooLong reports whether the topic exceeds the maximum topic length.
+func (l Limits) TopicTooLong(topic string) bool {
+	return l.MaxTopicLength > 0 && len(topic) > l.MaxTopicLength
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+// Protocol is the protocol the client uses to connect to mGate.
+type Protocol string
+
+const (
+	MQTT     Protocol = "mqtt"
+	MQTTWS   Protocol = "mqtt-ws"
+	HTTP     Protocol = "http"
+	HTTPWS   Protocol = "http-ws"
+	CoAP     Protocol = "coap"
+	CoAPDTLS Protocol = "coap-dtls"
+)
+
+// The messageKey type is unexported to prevent collisions with context keys defined in
+// other packages.
+type messageKey struct{}
+
+// Message holds metadata of the message being handled.
+// For messages published by MQTT client, QoS can be lowered and Retain
+// can be changed by Handler.AuthPublish. In all the other cases changes are ignored.
+type Message struct {
+	Protocol Protocol
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16
+}
+
+// NewMessageContext stores Message in context.Context values.
+// It uses pointer to the message so it can be modified by handler.
+func NewMessageContext(ctx context.Context, m *Message) context.Context {
+	return context.WithValue(ctx, messageKey{}, m)
+}
+
+// MessageFromContext retrieves Message from context.Context.
+// Second value indicates if message is present in the context
+// and if it's safe to use it (it's not nil).
+func MessageFromContext(ctx context.Context) (*Message, bool) {
+	if m, ok := ctx.Value(messageKey{}).(*Message); ok && m != nil {
+		return m, true
+	}
+	return nil, false
+}
+
+func newMessage(p *packets.Publish, protocol Protocol) *Message {
+	return &Message{
+		Protocol: protocol,
+		QoS:      p.QoS,
+		Retain:   p.Retain,
+		Dup:      p.Duplicate,
+		PacketID: p.PacketID,
+	}
+}
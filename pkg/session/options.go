@@ -0,0 +1,185 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/ratelimit"
+)
+
+// DenialPolicy defines what happens with PUBLISH packets sent by the broker
+// that the client is not authorized to receive.
+type DenialPolicy int
+
+const (
+	// DenialDisconnect sends DISCONNECT to the client and closes the session.
+	DenialDisconnect DenialPolicy = iota
+	// DenialDrop silently drops the message.
+	DenialDrop
+	// DenialDropAck drops the message and acknowledges QoS 1 and QoS 2
+	// messages to the broker on behalf of the client, so the broker does
+	// not keep the message in flight.
+	DenialDropAck
+)
+
+var errDenialPolicy = "unknown downstream denial policy %q"
+
+func (p DenialPolicy) String() string {
+	switch p {
+	case DenialDrop:
+		return "drop"
+	case DenialDropAck:
+		return "drop_ack"
+	default:
+		return "disconnect"
+	}
+}
+
+// UnmarshalText parses policy from its string representation,
+// so it can be loaded from environment variables.
+func (p *DenialPolicy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "disconnect":
+		*p = DenialDisconnect
+	case "drop":
+		*p = DenialDrop
+	case "drop_ack":
+		*p = DenialDropAck
+	default:
+		return fmt.Errorf(errDenialPolicy, text)
+	}
+	return nil
+}
+
+// Dialer opens the connection to the broker. The session is available in the context.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// Option configures the Stream.
+type Option func(*options)
+
+type options struct {
+	denialPolicy           DenialPolicy
+	localSubscriptionCheck bool
+	protocol               Protocol
+	registry               *Registry
+	connectTimeout         time.Duration
+	idleTimeout            time.Duration
+	limits                 Limits
+	limiter                *ratelimit.Limiter
+	dialer                 Dialer
+	header                 http.Header
+	group                  *Group
+	metrics                *metrics.Recorder
+}
+
+// WithDenialPolicy sets the policy applied to unauthorized PUBLISH packets sent by the broker.
+// Default policy is DenialDisconnect.
+func WithDenialPolicy(p DenialPolicy) Option {
+	return func(o *options) {
+		o.denialPolicy = p
+	}
+}
+
+// WithLocalSubscriptionCheck enables authorization of PUBLISH packets sent by the broker
+// against subscriptions granted in the session. Messages matching one of the granted
+// subscriptions are delivered without calling Handler.AuthSubscribe, which is called
+// only for the messages that do not match, such as the ones for subscriptions made
+// in the previous connections of a persistent session.
+func WithLocalSubscriptionCheck(enabled bool) Option {
+	return func(o *options) {
+		o.localSubscriptionCheck = enabled
+	}
+}
+
+// WithProtocol sets the protocol reported to the handler in the Session and the Message.
+// Default protocol is MQTT.
+func WithProtocol(p Protocol) Option {
+	return func(o *options) {
+		o.protocol = p
+	}
+}
+
+// WithRegistry registers the session in the registry for the duration of the Stream.
+func WithRegistry(r *Registry) Option {
+	return func(o *options) {
+		o.registry = r
+	}
+}
+
+// WithConnectTimeout sets the maximum time to wait for the client CONNECT packet.
+// Zero value means no timeout.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.connectTimeout = d
+	}
+}
+
+// WithIdleTimeout sets the maximum time to wait for any packet from the broker.
+// Zero value means no timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+// WithLimits sets the limits of the packets sent by the client.
+func WithLimits(l Limits) Option {
+	return func(o *options) {
+		o.limits = l
+	}
+}
+
+// WithRateLimiter sets the rate limiter applied to PUBLISH packets sent by the client.
+func WithRateLimiter(l *ratelimit.Limiter) Option {
+	return func(o *options) {
+		o.limiter = l
+	}
+}
+
+// WithDialer defers the broker connection until the client CONNECT is authorized,
+// so the broker can be selected by the client ID or username. The connection is
+// opened with the dialer when nil broker connection is passed to the Stream,
+// and it is closed when the Stream returns.
+func WithDialer(d Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// WithHeader sets HTTP headers of the WebSocket upgrade request reported to the handler in the Session.
+func WithHeader(h http.Header) Option {
+	return func(o *options) {
+		o.header = h
+	}
+}
+
+// WithGroup adds the session to the group, so it is closed gracefully when the proxy shuts down.
+// MQTT 5.0 clients receive DISCONNECT with the "Server shutting down" reason code.
+func WithGroup(g *Group) Option {
+	return func(o *options) {
+		o.group = g
+	}
+}
+
+// WithMetrics records the packets, the hooks and the broker connection failures of the session.
+func WithMetrics(r *metrics.Recorder) Option {
+	return func(o *options) {
+		o.metrics = r
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{protocol: MQTT}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
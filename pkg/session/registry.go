@@ -0,0 +1,303 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrSessionNotFound indicates there is no open session with the given ID.
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrPublishNotSupported indicates the session does not support messages published by mGate.
+	ErrPublishNotSupported = errors.New("session does not support publishing")
+
+	// ErrNotConnected indicates the connection of the client is not accepted by the broker yet.
+	ErrNotConnected = errors.New("client is not connected")
+)
+
+// Publication is a message published to the client by mGate, bypassing the broker.
+// It is sent with QoS 0, because packet identifiers of the messages sent to the
+// client are assigned by the broker.
+type Publication struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Retain  bool   `json:"retain"`
+}
+
+// Info describes an open session.
+// Received and sent counters are from the mGate point of view, so
+// received values describe traffic sent by the client.
+type Info struct {
+	ID              string    `json:"id"`
+	ClientID        string    `json:"client_id,omitempty"`
+	Username        string    `json:"username,omitempty"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Protocol        Protocol  `json:"protocol"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	PacketsReceived uint64    `json:"packets_received"`
+	PacketsSent     uint64    `json:"packets_sent"`
+}
+
+// Entry is an open session registered in the Registry.
+// All the methods are safe to call on nil Entry, so proxies
+// running without the registry don't need to check for it.
+type Entry struct {
+	id          string
+	protocol    Protocol
+	remoteAddr  string
+	connectedAt time.Time
+
+	bytesReceived   atomic.Uint64
+	bytesSent       atomic.Uint64
+	packetsReceived atomic.Uint64
+	packetsSent     atomic.Uint64
+
+	mu         sync.Mutex
+	clientID   string
+	username   string
+	disconnect func() error
+	publish    func(Publication) error
+}
+
+// ID returns the ID assigned to the session by the registry.
+func (e *Entry) ID() string {
+	if e == nil {
+		return ""
+	}
+	return e.id
+}
+
+// SetClient sets client ID and username once the client is authenticated.
+func (e *Entry) SetClient(clientID, username string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.clientID = clientID
+	e.username = username
+}
+
+// OnDisconnect sets the function used to forcibly close the session.
+func (e *Entry) OnDisconnect(f func() error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.disconnect = f
+}
+
+// OnPublish sets the function used to publish messages to the client.
+func (e *Entry) OnPublish(f func(Publication) error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.publish = f
+}
+
+// Received counts packets and bytes received from the client.
+func (e *Entry) Received(packets, bytes int) {
+	if e == nil {
+		return
+	}
+	e.packetsReceived.Add(uint64(packets))
+	e.bytesReceived.Add(uint64(bytes))
+}
+
+// Sent counts packets and bytes sent to the client.
+func (e *Entry) Sent(packets, bytes int) {
+	if e == nil {
+		return
+	}
+	e.packetsSent.Add(uint64(packets))
+	e.bytesSent.Add(uint64(bytes))
+}
+
+// Info returns a snapshot of the session state.
+func (e *Entry) Info() Info {
+	if e == nil {
+		return Info{}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Info{
+		ID:              e.id,
+		ClientID:        e.clientID,
+		Username:        e.username,
+		RemoteAddr:      e.remoteAddr,
+		Protocol:        e.protocol,
+		ConnectedAt:     e.connectedAt,
+		BytesReceived:   e.bytesReceived.Load(),
+		BytesSent:       e.bytesSent.Load(),
+		PacketsReceived: e.packetsReceived.Load(),
+		PacketsSent:     e.packetsSent.Load(),
+	}
+}
+
+func (e *Entry) close() error {
+	e.mu.Lock()
+	f := e.disconnect
+	e.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f()
+}
+
+func (e *Entry) send(pub Publication) error {
+	e.mu.Lock()
+	f := e.publish
+	e.mu.Unlock()
+	if f == nil {
+		return ErrPublishNotSupported
+	}
+	return f(pub)
+}
+
+// Registry keeps track of the sessions open in all the proxies.
+// It is safe for concurrent use. All the methods are safe to call
+// on nil Registry, and Register returns nil Entry in that case.
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Entry
+}
+
+// NewRegistry returns an empty session registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*Entry),
+	}
+}
+
+// Register adds a new session to the registry.
+func (r *Registry) Register(protocol Protocol, remoteAddr net.Addr) *Entry {
+	if r == nil {
+		return nil
+	}
+	e := &Entry{
+		id:          uuid.NewString(),
+		protocol:    protocol,
+		connectedAt: time.Now(),
+	}
+	if remoteAddr != nil {
+		e.remoteAddr = remoteAddr.String()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[e.id] = e
+	return e
+}
+
+// Unregister removes the closed session from the registry.
+func (r *Registry) Unregister(e *Entry) {
+	if r == nil || e == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, e.id)
+}
+
+// List returns all the open sessions ordered by connect time.
+func (r *Registry) List() []Info {
+	if r == nil {
+		return []Info{}
+	}
+	r.mu.RLock()
+	infos := make([]Info, 0, len(r.sessions))
+	for _, e := range r.sessions {
+		infos = append(infos, e.Info())
+	}
+	r.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Get returns the open session with the given ID.
+func (r *Registry) Get(id string) (Info, error) {
+	e, err := r.entry(id)
+	if err != nil {
+		return Info{}, err
+	}
+	return e.Info(), nil
+}
+
+// Disconnect forcibly closes the session with the given ID.
+func (r *Registry) Disconnect(id string) error {
+	e, err := r.entry(id)
+	if err != nil {
+		return err
+	}
+	return e.close()
+}
+
+// Publish sends the message to all the open sessions of the client with the given client ID.
+func (r *Registry) Publish(clientID string, pub Publication) error {
+	if r == nil {
+		return ErrSessionNotFound
+	}
+	var entries []*Entry
+	r.mu.RLock()
+	for _, e := range r.sessions {
+		if e.Info().ClientID == clientID {
+			entries = append(entries, e)
+		}
+	}
+	r.mu.RUnlock()
+	if len(entries) == 0 {
+		return ErrSessionNotFound
+	}
+	var errs []error
+	for _, e := range entries {
+		errs = append(errs, e.send(pub))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Registry) entry(id string) (*Entry, error) {
+	if r == nil {
+		return nil, ErrSessionNotFound
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return e, nil
+}
+
+// meteredConn counts bytes read from and written to the client connection.
+type meteredConn struct {
+	net.Conn
+	entry *Entry
+}
+
+func (c meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.entry.Received(0, n)
+	return n, err
+}
+
+func (c meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.entry.Sent(0, n)
+	return n, err
+}
@@ -5,19 +5,96 @@ package session
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
+	"net"
+	"net/http"
+
+	"github.com/absmach/mgate/pkg/proxyproto"
+	"github.com/absmach/mgate/pkg/ratelimit"
+	"github.com/eclipse/paho.golang/packets"
 )
 
 // The sessionKey type is unexported to prevent collisions with context keys defined in
 // other packages.
 type sessionKey struct{}
 
+// The causeKey type is unexported to prevent collisions with context keys defined in
+// other packages.
+type causeKey struct{}
+
+// The propertiesKey type is unexported to prevent collisions with context keys defined in
+// other packages.
+type propertiesKey struct{}
+
 // Session stores MQTT session data.
 type Session struct {
 	ID       string
 	Username string
 	Password []byte
 	Cert     x509.Certificate
+	// Subscriptions holds topic filters granted to the MQTT client.
+	// It is nil for protocols without subscriptions tracking.
+	Subscriptions *Subscriptions
+	// RateLimit is the rate the client may send messages at. It is set to the
+	// listener default, and it can be changed by the handler on AuthConnect.
+	RateLimit ratelimit.Limit
+	// ProxyHeader is PROXY protocol header of the client connection, which holds the original
+	// client address and the TLVs set by the load balancer. It is nil if PROXY protocol is not used.
+	ProxyHeader *proxyproto.Header
+	// RemoteAddr is the client address. It is the original client address if PROXY protocol is used.
+	RemoteAddr net.Addr
+	// LocalAddr is the address of the listener the client connected to.
+	LocalAddr net.Addr
+	// Protocol is the protocol the client connected with.
+	Protocol Protocol
+	// TLS holds the parameters of the client TLS or DTLS connection. It is nil for plain connections.
+	TLS *TLS
+	// Header holds HTTP headers of the request, or of the WebSocket upgrade request.
+	// It is nil for MQTT and CoAP clients.
+	Header http.Header
+}
+
+// VersionDTLS12 is the TLS.Version of DTLS 1.2 connections.
+const VersionDTLS12 uint16 = 0xFEFD
+
+// TLS holds the parameters of the client TLS or DTLS connection.
+type TLS struct {
+	// Version is the protocol version, such as tls.VersionTLS13 or VersionDTLS12.
+	Version uint16
+	// CipherSuite is the negotiated cipher suite ID.
+	CipherSuite uint16
+	// ServerName is the server name requested by the client with SNI.
+	ServerName string
+}
+
+// NewTLS returns the parameters of the TLS connection with the given state, or nil if the state is nil.
+func NewTLS(state *tls.ConnectionState) *TLS {
+	if state == nil {
+		return nil
+	}
+	return &TLS{
+		Version:     state.Version,
+		CipherSuite: state.CipherSuite,
+		ServerName:  state.ServerName,
+	}
+}
+
+// tlsFromConn returns the parameters of the TLS connection, unwrapping the connections
+// wrapping it, or nil if the connection is not a TLS one.
+func tlsFromConn(conn net.Conn) *TLS {
+	for conn != nil {
+		if c, ok := conn.(*tls.Conn); ok {
+			state := c.ConnectionState()
+			return NewTLS(&state)
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = u.NetConn()
+	}
+	return nil
 }
 
 // NewContext stores Session in context.Context values.
@@ -35,3 +112,31 @@ func FromContext(ctx context.Context) (*Session, bool) {
 	}
 	return nil, false
 }
+
+// NewPropertiesContext stores MQTT 5.0 properties of the packet being handled in context.Context values.
+// It uses pointer to the properties so they can be modified by handler.
+func NewPropertiesContext(ctx context.Context, p *packets.Properties) context.Context {
+	return context.WithValue(ctx, propertiesKey{}, p)
+}
+
+// PropertiesFromContext retrieves MQTT 5.0 properties of the packet being handled from context.Context.
+// Properties are present only for MQTT 5.0 clients, so the second value
+// indicates if properties are present in the context and are safe to use (not nil).
+func PropertiesFromContext(ctx context.Context) (*packets.Properties, bool) {
+	if p, ok := ctx.Value(propertiesKey{}).(*packets.Properties); ok && p != nil {
+		return p, true
+	}
+	return nil, false
+}
+
+// CauseFromContext retrieves the error that ended the session from the context
+// passed to Handler.Disconnect, such as ErrKeepAliveTimeout or io.EOF.
+// Second value indicates if the cause is present in the context.
+func CauseFromContext(ctx context.Context) (error, bool) {
+	err, ok := ctx.Value(causeKey{}).(error)
+	return err, ok && err != nil
+}
+
+func withCause(ctx context.Context, err error) context.Context {
+	return context.WithValue(ctx, causeKey{}, err)
+}
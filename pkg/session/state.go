@@ -0,0 +1,289 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// writer serializes writes of MQTT packets to a single connection.
+type writer struct {
+	mu    sync.Mutex
+	conn  net.Conn
+	codec codec
+	// entry counts packets written to the client. It is nil for the broker writer.
+	entry *Entry
+	// metrics records the packets in the direction of the writer.
+	metrics   *metrics.Recorder
+	direction string
+}
+
+func (w *writer) write(pkt *packets.ControlPacket) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cw := &countingWriter{w: w.conn}
+	if err := w.codec.write(cw, pkt); err != nil {
+		return err
+	}
+	w.entry.Sent(1, 0)
+	w.metrics.Packet(w.direction, pkt.PacketType(), cw.n)
+	return nil
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += n
+	return n, err
+}
+
+// pendingSubscribe is a SUBSCRIBE waiting for SUBACK from the broker.
+type pendingSubscribe struct {
+	// subs holds the subscriptions forwarded to the broker.
+	subs []packets.SubOptions
+	// reasons holds reason codes for all the topics of the original SUBSCRIBE
+	// packet if some of the topics are denied by mGate.
+	reasons []byte
+	// granted holds indexes of the topics forwarded to the broker.
+	granted []int
+}
+
+// state holds the data shared by both directions of the stream.
+type state struct {
+	codec   codec
+	opts    options
+	session *Session
+	entry   *Entry
+	client  *writer
+	broker  *writer
+	// deliveries is set only if the handler implements DeliveryHandler.
+	deliveries *deliveries
+	// connected is set once the broker accepts the connection.
+	connected atomic.Bool
+	// keepAlive is the keep alive period of the client.
+	keepAlive atomic.Int64
+	// span is the span of the connection, which the packet spans are linked to.
+	span trace.Span
+
+	mu sync.Mutex
+	// out is the broker connection. It is set later if the connection is deferred.
+	out          net.Conn
+	subscribes   map[uint16]pendingSubscribe
+	unsubscribes map[uint16][]string
+	// absorbed holds packet IDs of the downgraded QoS 2 client messages forwarded
+	// with QoS 1. The client is already acknowledged, so broker PUBACK is dropped.
+	absorbed map[uint16]struct{}
+	// released holds packet IDs of the QoS 2 client messages acknowledged by mGate.
+	// It is used only by the Up stream, so it does not need locking.
+	released map[uint16]struct{}
+	// denied holds packet IDs of the dropped QoS 2 messages sent by the broker.
+	// It is used only by the Down stream, so it does not need locking.
+	denied map[uint16]struct{}
+	// rejected holds the SUBSCRIBE packets partially denied by mGate until they are
+	// forwarded to the broker. It is used only by the Up stream, so it does not need locking.
+	rejected map[uint16]pendingSubscribe
+}
+
+func newState(c codec, in, out net.Conn, s *Session, e *Entry, opts options) *state {
+	return &state{
+		codec:        c,
+		opts:         opts,
+		session:      s,
+		entry:        e,
+		out:          out,
+		client:       &writer{conn: in, codec: c, entry: e, metrics: opts.metrics, direction: metrics.Down},
+		broker:       &writer{conn: out, codec: c, metrics: opts.metrics, direction: metrics.Up},
+		subscribes:   make(map[uint16]pendingSubscribe),
+		unsubscribes: make(map[uint16][]string),
+		absorbed:     make(map[uint16]struct{}),
+		released:     make(map[uint16]struct{}),
+		denied:       make(map[uint16]struct{}),
+		rejected:     make(map[uint16]pendingSubscribe),
+	}
+}
+
+// setBroker sets the broker connection opened after the stream started.
+// It must be called before the Down stream starts.
+func (s *state) setBroker(out net.Conn) {
+	s.broker.mu.Lock()
+	s.broker.conn = out
+	s.broker.mu.Unlock()
+	s.mu.Lock()
+	s.out = out
+	s.mu.Unlock()
+}
+
+// closeBroker closes the broker connection if it is open.
+func (s *state) closeBroker() error {
+	s.mu.Lock()
+	out := s.out
+	s.mu.Unlock()
+	if out == nil {
+		return nil
+	}
+	return out.Close()
+}
+
+// reject keeps the reason codes of the SUBSCRIBE packet partially denied by mGate.
+// They are pending only once the packet is forwarded to the broker, so the reasons
+// of the packet that fails later on don't leak into SUBACK of the one reusing its ID.
+func (s *state) reject(id uint16, ps pendingSubscribe) {
+	s.rejected[id] = ps
+}
+
+// trackSubscribe records subscriptions forwarded to the broker.
+func (s *state) trackSubscribe(p *packets.Subscribe) {
+	ps := s.rejected[p.PacketID]
+	delete(s.rejected, p.PacketID)
+	ps.subs = p.Subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribes[p.PacketID] = ps
+}
+
+// completeSuback records subscriptions granted by the broker and restores
+// SUBACK reason codes for the topics denied by mGate, so the client receives
+// a reason code for each of the topics it subscribed to.
+func (s *state) completeSuback(p *packets.Suback) {
+	s.mu.Lock()
+	ps, ok := s.subscribes[p.PacketID]
+	delete(s.subscribes, p.PacketID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for i, sub := range ps.subs {
+		if i < len(p.Reasons) && p.Reasons[i] < packets.SubackUnspecifiederror {
+			s.session.Subscriptions.Add(sub.Topic, p.Reasons[i])
+		}
+	}
+	if ps.reasons == nil {
+		return
+	}
+	for i, idx := range ps.granted {
+		if i < len(p.Reasons) {
+			ps.reasons[idx] = p.Reasons[i]
+		}
+	}
+	p.Reasons = ps.reasons
+}
+
+func (s *state) addUnsubscribe(id uint16, topics []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsubscribes[id] = topics
+}
+
+// completeUnsuback removes subscriptions the broker confirmed as unsubscribed.
+func (s *state) completeUnsuback(p *packets.Unsuback) {
+	s.mu.Lock()
+	topics, ok := s.unsubscribes[p.PacketID]
+	delete(s.unsubscribes, p.PacketID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for i, topic := range topics {
+		// MQTT 3.1.1 UNSUBACK carries no reason codes and always means success.
+		if i < len(p.Reasons) && p.Reasons[i] >= packets.UnsubackUnspecifiedError {
+			continue
+		}
+		s.session.Subscriptions.Remove(topic)
+	}
+}
+
+func (s *state) addDenied(id uint16) {
+	s.denied[id] = struct{}{}
+}
+
+// releaseDenied reports whether the packet ID belongs to a dropped QoS 2 message and forgets it.
+func (s *state) releaseDenied(id uint16) bool {
+	if _, ok := s.denied[id]; !ok {
+		return false
+	}
+	delete(s.denied, id)
+	return true
+}
+
+func (s *state) addAbsorbed(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.absorbed[id] = struct{}{}
+}
+
+// absorb reports whether the broker acknowledgement belongs to a downgraded message and forgets it.
+func (s *state) absorb(id uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.absorbed[id]; !ok {
+		return false
+	}
+	delete(s.absorbed, id)
+	return true
+}
+
+func (s *state) addReleased(id uint16) {
+	s.released[id] = struct{}{}
+}
+
+// release reports whether the client PUBREL belongs to a downgraded message and forgets it.
+func (s *state) release(id uint16) bool {
+	if _, ok := s.released[id]; !ok {
+		return false
+	}
+	delete(s.released, id)
+	return true
+}
+
+// publish sends the message published by mGate to the client. The client writer
+// serializes it with the packets forwarded from the broker.
+func (s *state) publish(pub Publication) error {
+	if !s.connected.Load() {
+		return ErrNotConnected
+	}
+	pkt := packets.NewControlPacket(packets.PUBLISH)
+	p := pkt.Content.(*packets.Publish)
+	p.Topic = pub.Topic
+	p.Payload = pub.Payload
+	p.Retain = pub.Retain
+	return s.client.write(pkt)
+}
+
+// setKeepAlive sets the client keep alive period in seconds.
+func (s *state) setKeepAlive(seconds uint16) {
+	s.keepAlive.Store(int64(time.Duration(seconds) * time.Second))
+}
+
+// setReadDeadline sets the deadline for reading the next packet in the given direction.
+// The client must send a packet within 1.5 times the keep alive period, and the broker
+// must send a packet within the idle timeout. Zero values disable the deadline.
+func (s *state) setReadDeadline(dir Direction) error {
+	var conn net.Conn
+	var d time.Duration
+	switch dir {
+	case Up:
+		conn = s.client.conn
+		d = time.Duration(s.keepAlive.Load()) * 3 / 2
+	default:
+		conn = s.broker.conn
+		d = s.opts.idleTimeout
+	}
+	if d == 0 {
+		return conn.SetReadDeadline(time.Time{})
+	}
+	return conn.SetReadDeadline(time.Now().Add(d))
+}
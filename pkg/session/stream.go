@@ -4,14 +4,20 @@
 package session
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/absmach/mgate/pkg/proxyproto"
+	"github.com/absmach/mgate/pkg/ratelimit"
+	"github.com/absmach/mgate/pkg/tracing"
+	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Direction int
@@ -24,138 +30,616 @@ const (
 const unknownID = "unknown"
 
 var (
-	errBroker = "failed to proxy from MQTT client with id %s to MQTT broker with error: %s"
-	errClient = "failed to proxy from MQTT broker to client with id %s with error: %s"
+	errBroker = "failed to proxy from MQTT client with id %s to MQTT broker with error: %w"
+	errClient = "failed to proxy from MQTT broker to client with id %s with error: %w"
+
+	errUnknownTopicAlias = "unknown topic alias %d"
+	errSubscriptionCount = errors.New("handler changed the number of subscription topics")
+	errNoDialer          = errors.New("broker connection or dialer is required")
 )
 
 // Stream starts proxy between client and broker.
-func Stream(ctx context.Context, in, out net.Conn, h Handler, preIc, postIc Interceptor, cert x509.Certificate) error {
+// The MQTT protocol version is detected from the client CONNECT packet, and
+// both MQTT 3.1.1 and MQTT 5.0 clients are supported on the same connection.
+// If out is nil, the broker connection is opened with the dialer set by WithDialer.
+func Stream(ctx context.Context, in, out net.Conn, h Handler, preIc, postIc Interceptor, cert x509.Certificate, opts ...Option) error {
 	s := Session{
-		Cert: cert,
+		Cert:          cert,
+		Subscriptions: NewSubscriptions(),
+		ProxyHeader:   proxyproto.HeaderFromConn(in),
 	}
 	ctx = NewContext(ctx, &s)
+
+	o := newOptions(opts)
+	h = InstrumentHandler(h, o.metrics)
+	s.RateLimit = o.limiter.Limit()
+	s.RemoteAddr = in.RemoteAddr()
+	s.LocalAddr = in.LocalAddr()
+	s.Protocol = o.protocol
+	s.TLS = tlsFromConn(in)
+	s.Header = o.header
+	m, err := o.group.Join()
+	if err != nil {
+		return errors.Join(wrap(ctx, err, Up), h.Disconnect(withCause(ctx, err)))
+	}
+	defer m.Leave()
+	m.OnShutdown(in.Close)
+	e := o.registry.Register(o.protocol, in.RemoteAddr())
+	defer o.registry.Unregister(e)
+	if e != nil {
+		in = meteredConn{Conn: in, entry: e}
+	}
+	e.OnDisconnect(func() error {
+		if out == nil {
+			return in.Close()
+		}
+		return errors.Join(in.Close(), out.Close())
+	})
+	if out == nil && o.dialer == nil {
+		return errors.Join(wrap(ctx, errNoDialer, Up), h.Disconnect(withCause(ctx, errNoDialer)))
+	}
+
+	// The first packet must be CONNECT, and it determines the protocol version
+	// used for the rest of the session in both directions.
+	if o.connectTimeout > 0 {
+		if err := in.SetReadDeadline(time.Now().Add(o.connectTimeout)); err != nil {
+			return errors.Join(wrap(ctx, err, Up), h.Disconnect(withCause(ctx, err)))
+		}
+	}
+	frame, err := readFrame(in, o.limits.MaxPacketSize)
+	if err != nil {
+		err = timeoutError(err, ErrConnectTimeout)
+		return errors.Join(wrap(ctx, err, Up), h.Disconnect(withCause(ctx, err)))
+	}
+	version, err := protocolVersion(frame)
+	if err != nil {
+		return errors.Join(wrap(ctx, err, Up), h.Disconnect(withCause(ctx, err)))
+	}
+	c, err := newCodec(version)
+	if err != nil {
+		return errors.Join(wrap(ctx, err, Up), h.Disconnect(withCause(ctx, err)))
+	}
+	r := io.MultiReader(bytes.NewReader(frame), in)
+	st := newState(c, in, out, &s, e, o)
+	st.span = trace.SpanFromContext(ctx)
+	if out == nil {
+		defer st.closeBroker()
+	}
+	// Let the client know the session is closed on purpose before closing the connections.
+	disconnect := func(reasonCode byte) func() error {
+		return func() error {
+			dc := packets.NewControlPacket(packets.DISCONNECT)
+			dc.Content.(*packets.Disconnect).ReasonCode = reasonCode
+			return errors.Join(st.client.write(dc), in.Close(), st.closeBroker())
+		}
+	}
+	e.OnDisconnect(disconnect(packets.DisconnectAdministrativeAction))
+	m.OnShutdown(disconnect(packets.DisconnectServerShuttingDown))
+	e.OnPublish(st.publish)
+	if _, ok := h.(DeliveryHandler); ok {
+		st.deliveries = newDeliveries()
+	}
+
 	errs := make(chan error, 2)
 
-	go stream(ctx, Up, in, out, h, preIc, postIc, errs)
-	go stream(ctx, Down, out, in, h, preIc, postIc, errs)
+	go stream(ctx, Up, r, st.broker, st, h, preIc, postIc, errs)
+	if out != nil {
+		go stream(ctx, Down, out, st.client, st, h, preIc, postIc, errs)
+	}
 
 	// Handle whichever error happens first.
 	// The other routine won't be blocked when writing
 	// to the errors channel because it is buffered.
-	err := <-errs
+	err = <-errs
 
-	disconnectErr := h.Disconnect(ctx)
+	disconnectErr := h.Disconnect(withCause(ctx, err))
 
 	return errors.Join(err, disconnectErr)
 }
 
-func stream(ctx context.Context, dir Direction, r, w net.Conn, h Handler, preIc, postIc Interceptor, errs chan error) {
+func stream(ctx context.Context, dir Direction, r io.Reader, w *writer, st *state, h Handler, preIc, postIc Interceptor, errs chan error) {
+	// Topic aliases are scoped to a single direction of the network connection.
+	aliases := make(map[uint16]string)
+	timeout := ErrKeepAliveTimeout
+	maxSize := st.opts.limits.MaxPacketSize
+	if dir == Down {
+		timeout = ErrIdleTimeout
+		maxSize = 0
+	}
 	for {
+		if err := st.setReadDeadline(dir); err != nil {
+			errs <- wrap(ctx, err, dir)
+			return
+		}
 		// Read from one connection.
-		pkt, err := packets.ReadPacket(r)
+		pkt, err := st.codec.read(r, maxSize)
+		if err != nil {
+			if errors.Is(err, ErrPacketTooLarge) {
+				err = reject(st, err)
+			}
+			errs <- wrap(ctx, timeoutError(err, timeout), dir)
+			return
+		}
+		// Each packet has its own span linked to the connection, so the session is not a single endless trace.
+		pctx, span := startPacket(ctx, pkt, dir, st)
+		err = proxy(pctx, dir, pkt, w, st, h, preIc, postIc, aliases, errs)
+		tracing.End(span, err)
 		if err != nil {
 			errs <- wrap(ctx, err, dir)
 			return
 		}
+	}
+}
 
-		if preIc != nil {
-			pkt, err = preIc.Intercept(ctx, pkt, dir)
+// proxy handles the packet read from the connection in the direction, and sends it to the other one.
+// The returned error means the session must be closed. Packets that are not forwarded return nil.
+func proxy(ctx context.Context, dir Direction, pkt *packets.ControlPacket, w *writer, st *state, h Handler, preIc, postIc Interceptor, aliases map[uint16]string, errs chan error) error {
+	if dir == Up {
+		st.entry.Received(1, 0)
+		if err := st.opts.limits.check(pkt); err != nil {
+			return reject(st, err)
+		}
+		if p, ok := pkt.Content.(*packets.Publish); ok {
+			dropped, err := rateLimit(ctx, p, st)
 			if err != nil {
-				errs <- wrap(ctx, err, dir)
-				return
+				return err
+			}
+			if dropped {
+				return nil
 			}
 		}
+	}
 
-		switch dir {
-		case Up:
-			if err = authorize(ctx, pkt, h); err != nil {
-				errs <- wrap(ctx, err, dir)
-				return
+	switch p := pkt.Content.(type) {
+	case *packets.Connect:
+		st.setKeepAlive(p.KeepAlive)
+	case *packets.Connack:
+		// MQTT 5.0 broker may override the keep alive requested by the client.
+		if p.Properties != nil && p.Properties.ServerKeepAlive != nil {
+			st.setKeepAlive(*p.Properties.ServerKeepAlive)
+		}
+		// Let MQTT 5.0 client know the maximum packet size mGate accepts.
+		if size := uint32(st.opts.limits.MaxPacketSize); size > 0 && p.Properties != nil &&
+			(p.Properties.MaximumPacketSize == nil || *p.Properties.MaximumPacketSize > size) {
+			p.Properties.MaximumPacketSize = &size
+		}
+	case *packets.Publish:
+		if err := resolveTopicAlias(p, aliases); err != nil {
+			return err
+		}
+	case *packets.Suback:
+		st.completeSuback(p)
+	case *packets.Unsuback:
+		st.completeUnsuback(p)
+	}
+
+	pkt, err := intercept(ctx, tracing.PreIntercept, preIc, pkt, dir)
+	if err != nil {
+		return err
+	}
+
+	switch dir {
+	case Up:
+		// Complete QoS 2 flow of the message acknowledged by mGate on behalf of the broker.
+		if p, ok := pkt.Content.(*packets.Pubrel); ok && st.release(p.PacketID) {
+			comp := packets.NewControlPacket(packets.PUBCOMP)
+			comp.Content.(*packets.Pubcomp).PacketID = p.PacketID
+			return st.client.write(comp)
+		}
+		if err = authorize(ctx, pkt, st, h); err != nil {
+			// Refuse the connection with CONNACK, so the client can tell
+			// the refusal reason apart from a network failure.
+			if _, ok := pkt.Content.(*packets.Connect); ok {
+				ack := packets.NewControlPacket(packets.CONNACK)
+				ack.Content.(*packets.Connack).ReasonCode = reasonCode(err, packets.ConnackNotAuthorized)
+				if wErr := st.client.write(ack); wErr != nil {
+					err = errors.Join(err, wErr)
+				}
 			}
-		default:
-			if p, ok := pkt.(*packets.PublishPacket); ok {
-				topics := []string{p.TopicName}
-				// The broker sends subscription messages to the client as Publish Packets.
-				// We need to check if the Publish packet sent by the broker is allowed to be received to by the client.
-				// Therefore, we are using handler.AuthSubscribe instead of handler.AuthPublish.
-				if err = h.AuthSubscribe(ctx, &topics); err != nil {
-					pkt = packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
-					if wErr := pkt.Write(w); wErr != nil {
-						err = errors.Join(err, wErr)
-					}
-					errs <- wrap(ctx, err, dir)
-					return
+			return err
+		}
+		// All the topics are denied and SUBACK is already sent to the client.
+		if p, ok := pkt.Content.(*packets.Subscribe); ok && len(p.Subscriptions) == 0 {
+			return nil
+		}
+		if _, ok := pkt.Content.(*packets.Connect); ok && st.broker.conn == nil {
+			if err := dial(ctx, st, h, preIc, postIc, errs); err != nil {
+				ack := packets.NewControlPacket(packets.CONNACK)
+				ack.Content.(*packets.Connack).ReasonCode = packets.ConnackServerUnavailable
+				if wErr := st.client.write(ack); wErr != nil {
+					err = errors.Join(err, wErr)
 				}
+				return err
 			}
 		}
-
-		if postIc != nil {
-			pkt, err = postIc.Intercept(ctx, pkt, dir)
-			if err != nil {
-				errs <- wrap(ctx, err, dir)
-				return
+	default:
+		switch p := pkt.Content.(type) {
+		case *packets.Publish:
+			if st.opts.localSubscriptionCheck && st.session.Subscriptions.Match(p.Topic) {
+				break
+			}
+			topics := []string{p.Topic}
+			// The broker sends subscription messages to the client as Publish Packets.
+			// We need to check if the Publish packet sent by the broker is allowed to be received to by the client.
+			// Therefore, we are using handler.AuthSubscribe instead of handler.AuthPublish.
+			mctx := NewMessageContext(withProperties(ctx, st.codec, p.Properties), newMessage(p, st.opts.protocol))
+			if err = h.AuthSubscribe(mctx, &topics); err != nil {
+				return deny(p, st, err)
+			}
+		case *packets.Pubrel:
+			// Complete QoS 2 flow of the dropped message on behalf of the client.
+			if st.releaseDenied(p.PacketID) {
+				comp := packets.NewControlPacket(packets.PUBCOMP)
+				comp.Content.(*packets.Pubcomp).PacketID = p.PacketID
+				return st.broker.write(comp)
+			}
+		case *packets.Puback:
+			// The client already received PUBACK from mGate for the downgraded message.
+			if st.absorb(p.PacketID) {
+				return delivered(ctx, dir, pkt, st, h)
 			}
 		}
+	}
 
-		// Send to another.
-		if err := pkt.Write(w); err != nil {
-			errs <- wrap(ctx, err, dir)
-			return
+	pkt, err = intercept(ctx, tracing.PostIntercept, postIc, pkt, dir)
+	if err != nil {
+		return err
+	}
+
+	// Track requests before sending, so the response can't outrun them.
+	switch p := pkt.Content.(type) {
+	case *packets.Subscribe:
+		st.trackSubscribe(p)
+	case *packets.Unsubscribe:
+		st.addUnsubscribe(p.PacketID, p.Topics)
+	case *packets.Publish:
+		if st.deliveries != nil {
+			st.deliveries.sent(dir, p)
+		}
+	}
+
+	// Send to another.
+	if err := forward(ctx, w, pkt, dir, st.codec); err != nil {
+		return err
+	}
+	if p, ok := pkt.Content.(*packets.Connack); ok && p.ReasonCode < packets.ConnackUnspecifiedError {
+		st.connected.Store(true)
+	}
+
+	// Notify only for packets sent from client to broker (incoming packets).
+	if dir == Up {
+		if err := notify(ctx, pkt, st, h); err != nil {
+			return err
 		}
+	}
+
+	return delivered(ctx, dir, pkt, st, h)
+}
+
+// dial opens the deferred broker connection once the client CONNECT is authorized,
+// and starts the Down stream. The broker connection is set only by the Up stream.
+// The Down stream runs in the context of the connection span rather than the CONNECT packet span.
+func dial(ctx context.Context, st *state, h Handler, preIc, postIc Interceptor, errs chan error) error {
+	dctx, span := tracing.Start(ctx, tracing.Dial)
+	out, err := st.opts.dialer(dctx)
+	tracing.End(span, err)
+	if err != nil {
+		st.opts.metrics.DialFailed()
+		return err
+	}
+	st.setBroker(out)
+	go stream(trace.ContextWithSpan(ctx, st.span), Down, out, st.client, st, h, preIc, postIc, errs)
+	return nil
+}
 
-		// Notify only for packets sent from client to broker (incoming packets).
-		if dir == Up {
-			if err := notify(ctx, pkt, h); err != nil {
-				errs <- wrap(ctx, err, dir)
+// delivered notifies DeliveryHandler if the acknowledgement completes a tracked delivery.
+func delivered(ctx context.Context, dir Direction, pkt *packets.ControlPacket, st *state, h Handler) error {
+	if st.deliveries == nil {
+		return nil
+	}
+	d, ok := st.deliveries.acked(dir, pkt)
+	if !ok {
+		return nil
+	}
+	return h.(DeliveryHandler).Delivered(ctx, d)
+}
+
+// reject closes the session because of the client packet exceeding the limits.
+// MQTT 5.0 client receives DISCONNECT with the reason code carried by the error,
+// while MQTT 3.1.1 connection is just closed.
+func reject(st *state, err error) error {
+	if st.codec.version() != V5 {
+		return err
+	}
+	dc := packets.NewControlPacket(packets.DISCONNECT)
+	dc.Content.(*packets.Disconnect).ReasonCode = reasonCode(err, packets.DisconnectImplementationSpecificError)
+	if wErr := st.client.write(dc); wErr != nil {
+		return errors.Join(err, wErr)
+	}
+	return err
+}
+
+// rateLimit applies the rate limit to the PUBLISH packet sent by the client and reports
+// whether the packet is dropped. The returned error means the session must be closed.
+func rateLimit(ctx context.Context, p *packets.Publish, st *state) (bool, error) {
+	s := st.session
+	key := st.opts.limiter.Key(s.ID, s.Username, st.client.conn.RemoteAddr().String())
+	err := st.opts.limiter.Wait(ctx, key, s.RateLimit, len(p.Payload))
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Is(err, ratelimit.ErrDropped):
+		return true, ackDropped(p, st)
+	default:
+		return false, reject(st, NewMQTTProxyError(packets.DisconnectMessageRateTooHigh, err))
+	}
+}
+
+// ackDropped completes the flow of the dropped QoS 1 and QoS 2 client message on behalf of the broker.
+func ackDropped(p *packets.Publish, st *state) error {
+	switch p.QoS {
+	case 1:
+		ack := packets.NewControlPacket(packets.PUBACK)
+		puback := ack.Content.(*packets.Puback)
+		puback.PacketID = p.PacketID
+		puback.ReasonCode = packets.PubackQuotaExceeded
+		return st.client.write(ack)
+	case 2:
+		rec := packets.NewControlPacket(packets.PUBREC)
+		pubrec := rec.Content.(*packets.Pubrec)
+		pubrec.PacketID = p.PacketID
+		pubrec.ReasonCode = packets.PubrecQuotaExceeded
+		// MQTT 5.0 client ends the flow on failed PUBREC, while MQTT 3.1.1 client responds with PUBREL.
+		if st.codec.version() != V5 {
+			st.addReleased(p.PacketID)
+		}
+		return st.client.write(rec)
+	default:
+		return nil
+	}
+}
+
+// deny applies the denial policy to the PUBLISH packet sent by the broker that
+// the client is not authorized to receive. The returned error means the session
+// must be closed, otherwise the packet is dropped.
+func deny(p *packets.Publish, st *state, err error) error {
+	switch st.opts.denialPolicy {
+	case DenialDrop:
+		return nil
+	case DenialDropAck:
+		switch p.QoS {
+		case 1:
+			ack := packets.NewControlPacket(packets.PUBACK)
+			puback := ack.Content.(*packets.Puback)
+			puback.PacketID = p.PacketID
+			puback.ReasonCode = packets.PubackNotAuthorized
+			return st.broker.write(ack)
+		case 2:
+			rec := packets.NewControlPacket(packets.PUBREC)
+			pubrec := rec.Content.(*packets.Pubrec)
+			pubrec.PacketID = p.PacketID
+			pubrec.ReasonCode = packets.PubrecNotAuthorized
+			// MQTT 5.0 broker ends the flow on failed PUBREC, while MQTT 3.1.1 broker responds with PUBREL.
+			if st.codec.version() != V5 {
+				st.addDenied(p.PacketID)
 			}
+			return st.broker.write(rec)
+		default:
+			return nil
 		}
+	default:
+		dc := packets.NewControlPacket(packets.DISCONNECT)
+		dc.Content.(*packets.Disconnect).ReasonCode = packets.DisconnectNotAuthorized
+		if wErr := st.client.write(dc); wErr != nil {
+			err = errors.Join(err, wErr)
+		}
+		return err
 	}
 }
 
-func authorize(ctx context.Context, pkt packets.ControlPacket, h Handler) error {
-	switch p := pkt.(type) {
-	case *packets.ConnectPacket:
+func authorize(ctx context.Context, pkt *packets.ControlPacket, st *state, h Handler) error {
+	c := st.codec
+	switch p := pkt.Content.(type) {
+	case *packets.Connect:
 		s, ok := FromContext(ctx)
 		if ok {
-			s.ID = p.ClientIdentifier
+			s.ID = p.ClientID
 			s.Username = p.Username
 			s.Password = p.Password
 		}
 
 		ctx = NewContext(ctx, s)
-		if err := h.AuthConnect(ctx); err != nil {
+		if err := h.AuthConnect(withProperties(ctx, c, p.Properties)); err != nil {
 			return err
 		}
 		// Copy back to the packet in case values are changed by Event handler.
 		// This is specific to CONN, as only that package type has credentials.
-		p.ClientIdentifier = s.ID
+		p.ClientID = s.ID
 		p.Username = s.Username
 		p.Password = s.Password
+		st.entry.SetClient(s.ID, s.Username)
+		st.span.SetAttributes(tracing.ClientIDKey.String(s.ID))
+		trace.SpanFromContext(ctx).SetAttributes(tracing.ClientIDKey.String(s.ID))
+		if !p.WillFlag {
+			return nil
+		}
+		// The Will message is published by the broker on behalf of the client,
+		// so it needs to be authorized just like any other client message.
+		msg := &Message{Protocol: st.opts.protocol, QoS: p.WillQOS, Retain: p.WillRetain}
+		wctx := NewMessageContext(withProperties(ctx, c, p.WillProperties), msg)
+		var err error
+		if wh, ok := h.(WillHandler); ok {
+			err = wh.AuthWill(wctx, &p.WillTopic, &p.WillMessage)
+		} else {
+			err = h.AuthPublish(wctx, &p.WillTopic, &p.WillMessage)
+		}
+		if err != nil {
+			return err
+		}
+		p.WillRetain = msg.Retain
+		p.WillQOS = min(msg.QoS, p.WillQOS)
 		return nil
-	case *packets.PublishPacket:
-		return h.AuthPublish(ctx, &p.TopicName, &p.Payload)
-	case *packets.SubscribePacket:
-		return h.AuthSubscribe(ctx, &p.Topics)
+	case *packets.Publish:
+		msg := newMessage(p, st.opts.protocol)
+		if err := h.AuthPublish(NewMessageContext(withProperties(ctx, c, p.Properties), msg), &p.Topic, &p.Payload); err != nil {
+			return err
+		}
+		p.Retain = msg.Retain
+		if msg.QoS < p.QoS {
+			return downgrade(p, msg.QoS, st)
+		}
+		return nil
+	case *packets.Subscribe:
+		return authorizeSubscribe(ctx, p, st, h)
 	default:
 		return nil
 	}
 }
 
-func notify(ctx context.Context, pkt packets.ControlPacket, h Handler) error {
-	switch p := pkt.(type) {
-	case *packets.ConnectPacket:
-		return h.Connect(ctx)
-	case *packets.PublishPacket:
-		return h.Publish(ctx, &p.TopicName, &p.Payload)
-	case *packets.SubscribePacket:
-		return h.Subscribe(ctx, &p.Topics)
-	case *packets.UnsubscribePacket:
-		return h.Unsubscribe(ctx, &p.Topics)
+// authorizeSubscribe removes the topics denied by the handler from the SUBSCRIBE packet.
+// If some of the topics are denied, the reason codes are kept until the broker
+// responds with SUBACK. If all the topics are denied, SUBACK is sent to the client
+// right away and the packet is not forwarded to the broker.
+func authorizeSubscribe(ctx context.Context, p *packets.Subscribe, st *state, h Handler) error {
+	topics := subscriptionTopics(p)
+	delete(st.rejected, p.PacketID)
+	authErr := h.AuthSubscribe(withProperties(ctx, st.codec, p.Properties), &topics)
+	if err := setSubscriptionTopics(p, topics); err != nil {
+		return err
+	}
+	if authErr == nil {
+		return nil
+	}
+
+	// The error may be wrapped by the handler, so the per-topic results are looked up in the chain.
+	var se SubscribeError
+	perTopic := errors.As(authErr, &se)
+	reasons := make([]byte, len(p.Subscriptions))
+	var subs []packets.SubOptions
+	var granted []int
+	for i, sub := range p.Subscriptions {
+		err := authErr
+		if perTopic {
+			err = nil
+			if errs := se.Errors(); i < len(errs) {
+				err = errs[i]
+			}
+		}
+		if err != nil {
+			reasons[i] = reasonCode(err, packets.SubackNotauthorized)
+			continue
+		}
+		subs = append(subs, sub)
+		granted = append(granted, i)
+	}
+	if len(granted) == len(reasons) {
+		return nil
+	}
+	p.Subscriptions = subs
+	if len(subs) > 0 {
+		st.reject(p.PacketID, pendingSubscribe{reasons: reasons, granted: granted})
+		return nil
+	}
+
+	ack := packets.NewControlPacket(packets.SUBACK)
+	suback := ack.Content.(*packets.Suback)
+	suback.PacketID = p.PacketID
+	suback.Reasons = reasons
+	return st.client.write(ack)
+}
+
+// downgrade lowers QoS of the PUBLISH packet sent by the client. The broker does not
+// complete the flow the client started with the original QoS, so mGate acknowledges
+// the message to the client on behalf of the broker.
+func downgrade(p *packets.Publish, qos byte, st *state) error {
+	id := p.PacketID
+	orig := p.QoS
+	p.QoS = qos
+	if qos == 0 {
+		p.PacketID = 0
+	}
+	if orig == 1 {
+		ack := packets.NewControlPacket(packets.PUBACK)
+		ack.Content.(*packets.Puback).PacketID = id
+		return st.client.write(ack)
+	}
+	if qos == 1 {
+		st.addAbsorbed(id)
+	}
+	st.addReleased(id)
+	rec := packets.NewControlPacket(packets.PUBREC)
+	rec.Content.(*packets.Pubrec).PacketID = id
+	return st.client.write(rec)
+}
+
+func notify(ctx context.Context, pkt *packets.ControlPacket, st *state, h Handler) error {
+	c := st.codec
+	switch p := pkt.Content.(type) {
+	case *packets.Connect:
+		return h.Connect(withProperties(ctx, c, p.Properties))
+	case *packets.Publish:
+		mctx := NewMessageContext(withProperties(ctx, c, p.Properties), newMessage(p, st.opts.protocol))
+		return h.Publish(mctx, &p.Topic, &p.Payload)
+	case *packets.Subscribe:
+		topics := subscriptionTopics(p)
+		return h.Subscribe(withProperties(ctx, c, p.Properties), &topics)
+	case *packets.Unsubscribe:
+		return h.Unsubscribe(withProperties(ctx, c, p.Properties), &p.Topics)
 	default:
 		return nil
 	}
 }
 
+// withProperties exposes packet properties to the handler for MQTT 5.0 sessions.
+func withProperties(ctx context.Context, c codec, props *packets.Properties) context.Context {
+	if c.version() != V5 {
+		return ctx
+	}
+	return NewPropertiesContext(ctx, props)
+}
+
+// resolveTopicAlias replaces topic alias with the topic it stands for.
+// The alias is removed from the packet, so the topic can safely be
+// changed by the handler and the receiver does not depend on alias
+// mapping that mGate may have altered.
+func resolveTopicAlias(p *packets.Publish, aliases map[uint16]string) error {
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		return nil
+	}
+	alias := *p.Properties.TopicAlias
+	switch p.Topic {
+	case "":
+		topic, ok := aliases[alias]
+		if !ok {
+			return fmt.Errorf(errUnknownTopicAlias, alias)
+		}
+		p.Topic = topic
+	default:
+		aliases[alias] = p.Topic
+	}
+	p.Properties.TopicAlias = nil
+	return nil
+}
+
+func subscriptionTopics(p *packets.Subscribe) []string {
+	topics := make([]string, len(p.Subscriptions))
+	for i, s := range p.Subscriptions {
+		topics[i] = s.Topic
+	}
+	return topics
+}
+
+// setSubscriptionTopics copies back topics in case they are changed by the handler.
+func setSubscriptionTopics(p *packets.Subscribe, topics []string) error {
+	if len(topics) != len(p.Subscriptions) {
+		return errSubscriptionCount
+	}
+	for i := range p.Subscriptions {
+		p.Subscriptions[i].Topic = topics[i]
+	}
+	return nil
+}
+
 func wrap(ctx context.Context, err error, dir Direction) error {
 	if err == io.EOF {
 		return err
@@ -166,9 +650,9 @@ func wrap(ctx context.Context, err error, dir Direction) error {
 	}
 	switch dir {
 	case Up:
-		return fmt.Errorf(errClient, cid, err.Error())
+		return fmt.Errorf(errClient, cid, err)
 	case Down:
-		return fmt.Errorf(errBroker, cid, err.Error())
+		return fmt.Errorf(errBroker, cid, err)
 	default:
 		return err
 	}
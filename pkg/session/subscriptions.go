@@ -0,0 +1,98 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	sharePrefix    = "$share/"
+	singleWildcard = "+"
+	multiWildcard  = "#"
+	levelSeparator = "/"
+)
+
+// Subscriptions is a set of topic filters granted to the client by the broker.
+// It is safe for concurrent use.
+type Subscriptions struct {
+	mu      sync.RWMutex
+	filters map[string]byte
+}
+
+// NewSubscriptions returns an empty set of subscriptions.
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{
+		filters: make(map[string]byte),
+	}
+}
+
+// Add adds topic filter granted with the given QoS.
+func (s *Subscriptions) Add(filter string, qos byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filters[filter] = qos
+}
+
+// Remove removes topic filter.
+func (s *Subscriptions) Remove(filter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.filters, filter)
+}
+
+// Filters returns granted topic filters with their QoS.
+func (s *Subscriptions) Filters() map[string]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	filters := make(map[string]byte, len(s.filters))
+	for f, qos := range s.filters {
+		filters[f] = qos
+	}
+	return filters
+}
+
+// Match reports whether the topic matches any of the granted topic filters.
+func (s *Subscriptions) Match(topic string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for f := range s.filters {
+		if MatchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic reports whether the topic name matches the topic filter.
+// Filter may contain `+` and `#` wildcards and may be a shared subscription.
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(filter, sharePrefix) {
+		// Shared subscription filter has the form of $share/{ShareName}/{filter}.
+		parts := strings.SplitN(filter, levelSeparator, 3)
+		if len(parts) != 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+	// Topics starting with $ are not matched by filters starting with wildcard.
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, singleWildcard) || strings.HasPrefix(filter, multiWildcard)) {
+		return false
+	}
+
+	fl := strings.Split(filter, levelSeparator)
+	tl := strings.Split(topic, levelSeparator)
+	for i, f := range fl {
+		switch {
+		case f == multiWildcard:
+			return i == len(fl)-1
+		case i >= len(tl):
+			return false
+		case f != singleWildcard && f != tl[i]:
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
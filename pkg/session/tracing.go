@@ -0,0 +1,152 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"slices"
+
+	"github.com/absmach/mgate/pkg/metrics"
+	"github.com/absmach/mgate/pkg/tracing"
+	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// directions maps the stream directions to the ones used in the metrics and the spans.
+var directions = map[Direction]string{Up: metrics.Up, Down: metrics.Down}
+
+// userProperties carries the trace context in the user properties of MQTT 5.0 packets.
+type userProperties struct {
+	props *packets.Properties
+}
+
+var _ propagation.TextMapCarrier = userProperties{}
+
+func (u userProperties) Get(key string) string {
+	for _, p := range u.props.User {
+		if p.Key == key {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+func (u userProperties) Set(key, value string) {
+	user := u.props.User[:0:0]
+	for _, p := range u.props.User {
+		if p.Key != key {
+			user = append(user, p)
+		}
+	}
+	u.props.User = append(user, packets.User{Key: key, Value: value})
+}
+
+func (u userProperties) Keys() []string {
+	keys := make([]string, len(u.props.User))
+	for i, p := range u.props.User {
+		keys[i] = p.Key
+	}
+	return keys
+}
+
+// properties returns the properties of the packet that can carry the trace context sent
+// by MQTT 5.0 client or broker, or nil if the packet can't carry it.
+func properties(pkt *packets.ControlPacket, c codec) **packets.Properties {
+	if c.version() != V5 {
+		return nil
+	}
+	switch p := pkt.Content.(type) {
+	case *packets.Connect:
+		return &p.Properties
+	case *packets.Publish:
+		return &p.Properties
+	case *packets.Subscribe:
+		return &p.Properties
+	case *packets.Unsubscribe:
+		return &p.Properties
+	default:
+		return nil
+	}
+}
+
+// startPacket starts the span of the packet read from the client or the broker.
+// The packet continues the trace propagated in its user properties, if any.
+func startPacket(ctx context.Context, pkt *packets.ControlPacket, dir Direction, st *state) (context.Context, trace.Span) {
+	var carrier propagation.TextMapCarrier
+	if props := properties(pkt, st.codec); props != nil && *props != nil {
+		carrier = userProperties{props: *props}
+	}
+	s := st.session
+	ctx, span := tracing.StartMessage(ctx, pkt.PacketType(), carrier,
+		trace.WithAttributes(
+			tracing.ProtocolKey.String(string(s.Protocol)),
+			tracing.DirectionKey.String(directions[dir]),
+			tracing.ClientIDKey.String(s.ID),
+		))
+	if p, ok := pkt.Content.(*packets.Publish); ok && p.Topic != "" {
+		span.SetAttributes(tracing.TopicKey.String(p.Topic))
+	}
+	return ctx, span
+}
+
+// intercept calls the interceptor, if any, in its span.
+func intercept(ctx context.Context, name string, ic Interceptor, pkt *packets.ControlPacket, dir Direction) (*packets.ControlPacket, error) {
+	if ic == nil {
+		return pkt, nil
+	}
+	ctx, span := tracing.Start(ctx, name)
+	pkt, err := ic.Intercept(ctx, pkt, dir)
+	tracing.End(span, err)
+	return pkt, err
+}
+
+// forward writes the packet in its span. The trace context of PUBLISH and CONNECT packets
+// sent to the broker is propagated in the user properties. The broker passes the user properties
+// of PUBLISH packets on to the subscribers, so the trace context is removed from the ones sent
+// to the client, and the trace IDs don't leak to the clients.
+func forward(ctx context.Context, w *writer, pkt *packets.ControlPacket, dir Direction, c codec) error {
+	switch dir {
+	case Up:
+		inject(ctx, pkt, c)
+	default:
+		strip(pkt, c)
+	}
+	_, span := tracing.Start(ctx, tracing.Write)
+	err := w.write(pkt)
+	tracing.End(span, err)
+	return err
+}
+
+// strip removes the trace context from the user properties of MQTT 5.0 PUBLISH packets.
+func strip(pkt *packets.ControlPacket, c codec) {
+	if _, ok := pkt.Content.(*packets.Publish); !ok {
+		return
+	}
+	props := properties(pkt, c)
+	if props == nil || *props == nil {
+		return
+	}
+	fields := tracing.Fields()
+	(*props).User = slices.DeleteFunc((*props).User, func(u packets.User) bool {
+		return slices.Contains(fields, u.Key)
+	})
+}
+
+// inject propagates the trace context in the user properties of MQTT 5.0 PUBLISH and CONNECT packets.
+func inject(ctx context.Context, pkt *packets.ControlPacket, c codec) {
+	switch pkt.Content.(type) {
+	case *packets.Publish, *packets.Connect:
+	default:
+		return
+	}
+	props := properties(pkt, c)
+	if props == nil {
+		return
+	}
+	if *props == nil {
+		*props = &packets.Properties{}
+	}
+	tracing.Inject(ctx, userProperties{props: *props})
+}
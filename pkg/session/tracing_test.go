@@ -0,0 +1,152 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session_test
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/absmach/mgate/pkg/session"
+	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID    = "00f067aa0ba902b7"
+	traceparent = "00-" + traceID + "-" + parentID + "-01"
+)
+
+type handler struct{}
+
+func (handler) AuthConnect(context.Context) error                   { return nil }
+func (handler) AuthPublish(context.Context, *string, *[]byte) error { return nil }
+func (handler) AuthSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) Connect(context.Context) error                       { return nil }
+func (handler) Publish(context.Context, *string, *[]byte) error     { return nil }
+func (handler) Subscribe(context.Context, *[]string) error          { return nil }
+func (handler) Unsubscribe(context.Context, *[]string) error        { return nil }
+func (handler) Disconnect(context.Context) error                    { return nil }
+
+func TestStreamTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = tp.Shutdown(context.Background())
+	})
+
+	client, in := net.Pipe()
+	out, broker := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- session.Stream(ctx, in, out, handler{}, nil, nil, x509.Certificate{}, session.WithProtocol(session.MQTT))
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		broker.Close()
+		<-errs
+	})
+
+	connect := packets.NewControlPacket(packets.CONNECT)
+	c := connect.Content.(*packets.Connect)
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = 5
+	c.ClientID = "client"
+	c.CleanStart = true
+	c.Properties = &packets.Properties{User: []packets.User{{Key: "traceparent", Value: traceparent}}}
+	send(t, client, connect)
+
+	// CONNECT continues the trace of the client, and the packet span is propagated to the broker.
+	got := receive(t, broker).Content.(*packets.Connect)
+	tp0 := userProperty(got.Properties, "traceparent")
+
+	connack := packets.NewControlPacket(packets.CONNACK)
+	connack.Content.(*packets.Connack).Properties = &packets.Properties{}
+	send(t, broker, connack)
+	if ack := receive(t, client).Content.(*packets.Connack); userProperty(ack.Properties, "traceparent") != "" {
+		t.Fatal("expected no traceparent in the packet sent to the client")
+	}
+
+	// The message sent to the client never carries the trace context, even the one
+	// the broker passed on from the publisher, while the other properties are kept.
+	for _, props := range []*packets.Properties{
+		{},
+		{User: []packets.User{{Key: "traceparent", Value: tp0}, {Key: "tracestate", Value: "mgate=1"}, {Key: "k", Value: "v"}}},
+	} {
+		pub := packets.NewControlPacket(packets.PUBLISH)
+		pub.Content.(*packets.Publish).Topic = "t"
+		pub.Content.(*packets.Publish).Payload = []byte("m")
+		pub.Content.(*packets.Publish).Properties = props
+		send(t, broker, pub)
+		p := receive(t, client).Content.(*packets.Publish)
+		if userProperty(p.Properties, "traceparent") != "" || userProperty(p.Properties, "tracestate") != "" {
+			t.Fatal("expected no trace context in the message sent to the client")
+		}
+		if len(props.User) > 0 && userProperty(p.Properties, "k") != "v" {
+			t.Fatal("expected the other user properties in the message sent to the client")
+		}
+	}
+
+	var span sdktrace.ReadOnlySpan
+	for _, s := range exporter.GetSpans().Snapshots() {
+		if s.Name() == "CONNECT" {
+			span = s
+		}
+	}
+	if span == nil {
+		t.Fatal("expected CONNECT span to be recorded")
+	}
+	if id := span.SpanContext().TraceID().String(); id != traceID {
+		t.Fatalf("expected CONNECT span in trace %s, got %s", traceID, id)
+	}
+	if id := span.Parent().SpanID().String(); id != parentID {
+		t.Fatalf("expected CONNECT span with parent %s, got %s", parentID, id)
+	}
+	if want := "00-" + traceID + "-" + span.SpanContext().SpanID().String() + "-01"; tp0 != want {
+		t.Fatalf("expected traceparent %q of the CONNECT span, got %q", want, tp0)
+	}
+}
+
+func send(t *testing.T, conn net.Conn, pkt *packets.ControlPacket) {
+	t.Helper()
+	go func() {
+		if _, err := pkt.WriteTo(conn); err != nil {
+			t.Errorf("failed to write %s: %s", pkt.PacketType(), err)
+		}
+	}()
+}
+
+func receive(t *testing.T, conn net.Conn) *packets.ControlPacket {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("failed to read packet: %s", err)
+	}
+	return pkt
+}
+
+func userProperty(props *packets.Properties, key string) string {
+	if props == nil {
+		return ""
+	}
+	for _, u := range props.User {
+		if u.Key == key {
+			return u.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/pion/dtls/v3"
+)
+
+var (
+	errLoadClientCerts = errors.New("failed to load client certificates")
+	errLoadCA          = errors.New("failed to load CA")
+	errTLSVersion      = "unknown TLS version %q"
+)
+
+// Version is the TLS protocol version.
+type Version uint16
+
+// UnmarshalText parses TLS version from its string representation,
+// so it can be loaded from environment variables.
+func (v *Version) UnmarshalText(text []byte) error {
+	switch strings.TrimSpace(string(text)) {
+	case "":
+		*v = 0
+	case "1.0":
+		*v = tls.VersionTLS10
+	case "1.1":
+		*v = tls.VersionTLS11
+	case "1.2":
+		*v = tls.VersionTLS12
+	case "1.3":
+		*v = tls.VersionTLS13
+	default:
+		return fmt.Errorf(errTLSVersion, text)
+	}
+	return nil
+}
+
+func (v Version) String() string {
+	if v == 0 {
+		return "default"
+	}
+	return tls.VersionName(uint16(v))
+}
+
+// ClientConfig is the configuration of TLS connections to the upstream server.
+type ClientConfig struct {
+	Enabled bool `env:"ENABLED"     envDefault:"false"`
+	// CAFile is the CA the server certificate is verified with. System CAs are used if it's empty.
+	CAFile string `env:"CA_FILE"     envDefault:""`
+	// CertFile and KeyFile are the client certificate for mTLS.
+	CertFile string `env:"CERT_FILE"   envDefault:""`
+	KeyFile  string `env:"KEY_FILE"    envDefault:""`
+	// ServerName is the name the server certificate is verified against. Target host is used if it's empty.
+	ServerName string `env:"SERVER_NAME" envDefault:""`
+	// MinVersion is the minimum TLS version. It does not apply to DTLS, which supports only DTLS 1.2.
+	MinVersion Version `env:"MIN_VERSION" envDefault:"1.2"`
+}
+
+func NewClientConfig(opts env.Options) (ClientConfig, error) {
+	c := ClientConfig{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return ClientConfig{}, err
+	}
+	return c, nil
+}
+
+// LoadClientTLSConfig returns a TLS or DTLS configuration that can be used for TLS or DTLS clients.
+// It returns nil if TLS is not enabled.
+func LoadClientTLSConfig[sc TLSConfig](c *ClientConfig, s sc) (sc, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	var certificates []tls.Certificate
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Join(errLoadClientCerts, err)
+		}
+		certificates = []tls.Certificate{certificate}
+	}
+
+	ca, err := loadCertFile(c.CAFile)
+	if err != nil {
+		return nil, errors.Join(errLoadCA, err)
+	}
+	var rootCAs *x509.CertPool
+	if len(ca) > 0 {
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(ca) {
+			return nil, errAppendCA
+		}
+	}
+
+	switch config := any(s).(type) {
+	case *tls.Config:
+		config.Certificates = certificates
+		config.RootCAs = rootCAs
+		config.ServerName = c.ServerName
+		config.MinVersion = uint16(c.MinVersion)
+		return s, nil
+	case *dtls.Config:
+		config.Certificates = certificates
+		config.RootCAs = rootCAs
+		config.ServerName = c.ServerName
+		return s, nil
+	default:
+		return nil, errUnsupportedTLS
+	}
+}
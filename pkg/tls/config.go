@@ -4,6 +4,8 @@
 package tls
 
 import (
+	"time"
+
 	"github.com/absmach/mgate/pkg/tls/verifier"
 	"github.com/caarlos0/env/v11"
 )
@@ -13,7 +15,22 @@ type Config struct {
 	KeyFile      string `env:"KEY_FILE"       envDefault:""`
 	ServerCAFile string `env:"SERVER_CA_FILE" envDefault:""`
 	ClientCAFile string `env:"CLIENT_CA_FILE" envDefault:""`
-	Validator    verifier.Validator
+	// ClientAuth is the client authentication mode. By default, the client certificate
+	// is required and verified if the client CA file is set.
+	ClientAuth ClientAuth `env:"CLIENT_AUTH" envDefault:""`
+	// Hosts are the certificates and the client authentication policies selected by
+	// the server name the client requests with SNI.
+	Hosts []HostConfig `envPrefix:"SNI_"`
+	// ReloadInterval is the interval the files are checked for changes at. Zero disables
+	// the checks, and the certificates are reloaded on SIGHUP only.
+	ReloadInterval time.Duration `env:"RELOAD_INTERVAL" envDefault:"10s"`
+	Validator      verifier.Validator
+	certs          *Certificates
+}
+
+// Certificates returns the certificates loaded by LoadTLSConfig, or nil if TLS is not configured.
+func (c *Config) Certificates() *Certificates {
+	return c.certs
 }
 
 func NewConfig(opts env.Options) (Config, error) {
@@ -0,0 +1,329 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/absmach/mgate/pkg/tls/verifier"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/protocol/handshake"
+)
+
+// sniTTL is the time the server name requested by the DTLS client is kept for after the handshake.
+const sniTTL = time.Minute
+
+var (
+	errNoClientCert = errors.New("client certificate is required")
+	errNoClientCA   = errors.New("client CA is required to verify client certificates")
+)
+
+// material is the server certificates and the CA pools loaded at once.
+type material struct {
+	rootCAs *x509.CertPool
+	def     *host
+	hosts   []*host
+}
+
+// sni is the server name requested by the DTLS client with the given hello random bytes.
+type sni struct {
+	name string
+	at   time.Time
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Certificates holds the server certificates and the CA pools loaded from the files
+// in the Config. They can be reloaded while the server is running, and the new
+// material is used for the new connections, while the open ones are not affected.
+// The certificate and the client authentication policy are selected by the server
+// name the client requests with SNI, falling back to the ones of the listener.
+type Certificates struct {
+	config   *Config
+	material atomic.Pointer[material]
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+
+	snisMu sync.Mutex
+	snis   map[[handshake.RandomBytesLength]byte]sni
+}
+
+// LoadCertificates loads the certificates from the files in the Config.
+func LoadCertificates(c *Config) (*Certificates, error) {
+	certs := &Certificates{
+		config: c,
+		snis:   make(map[[handshake.RandomBytesLength]byte]sni),
+	}
+	if err := certs.Reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Reload loads the certificates from the files again. If any of the files
+// fails to load, the current certificates are kept.
+func (c *Certificates) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stamps = c.stat()
+
+	m, err := c.load()
+	if err != nil {
+		return err
+	}
+	c.material.Store(m)
+	return nil
+}
+
+func (c *Certificates) load() (*material, error) {
+	certificate, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return nil, errors.Join(errLoadCerts, err)
+	}
+
+	// Loading Server CA file
+	rootCAs, err := loadCertPool(c.config.ServerCAFile)
+	if err != nil {
+		return nil, errors.Join(errLoadServerCA, err)
+	}
+
+	// Loading Client CA File
+	clientCAs, err := loadCertPool(c.config.ClientCAFile)
+	if err != nil {
+		return nil, errors.Join(errLoadClientCA, err)
+	}
+
+	m := &material{
+		rootCAs: rootCAs,
+		def:     newHost("", &certificate, clientCAs, c.config.ClientAuth),
+	}
+	if m.def.auth.verifies() && m.def.clientCAs == nil {
+		return nil, errNoClientCA
+	}
+	for _, hc := range c.config.Hosts {
+		cert := &certificate
+		if hc.CertFile != "" || hc.KeyFile != "" {
+			hostCert, err := tls.LoadX509KeyPair(hc.CertFile, hc.KeyFile)
+			if err != nil {
+				return nil, errors.Join(errLoadCerts, err)
+			}
+			cert = &hostCert
+		}
+		hostCAs := clientCAs
+		if hc.ClientCAFile != "" {
+			if hostCAs, err = loadCertPool(hc.ClientCAFile); err != nil {
+				return nil, errors.Join(errLoadClientCA, err)
+			}
+		}
+		h := newHost(hc.ServerName, cert, hostCAs, hc.ClientAuth)
+		if h.auth.verifies() && h.clientCAs == nil {
+			return nil, errNoClientCA
+		}
+		m.hosts = append(m.hosts, h)
+	}
+	return m, nil
+}
+
+// loadCertPool returns the pool with the certificates from the file, or nil if the file is not set.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := loadCertFile(file)
+	if err != nil || len(pem) == 0 {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errAppendCA
+	}
+	return pool, nil
+}
+
+// Watch reloads the certificates when the files change, checking them every
+// Config.ReloadInterval, or when the process receives SIGHUP, until the context
+// is done. Failed reloads keep the current certificates, and the error is logged.
+func (c *Certificates) Watch(ctx context.Context, logger *slog.Logger) {
+	if c == nil {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if c.config.ReloadInterval > 0 {
+		t := time.NewTicker(c.config.ReloadInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if !c.changed() {
+				continue
+			}
+		}
+		if err := c.Reload(); err != nil {
+			logger.Error("Failed to reload TLS certificates, keeping the current ones", slog.String("cert_file", c.config.CertFile), slog.Any("error", err))
+			continue
+		}
+		logger.Info("Reloaded TLS certificates", slog.String("cert_file", c.config.CertFile))
+	}
+}
+
+func (c *Certificates) current() *material {
+	return c.material.Load()
+}
+
+// changed reports if any of the files changed since the last reload.
+func (c *Certificates) changed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stamps := c.stat()
+	if len(stamps) != len(c.stamps) {
+		return true
+	}
+	for name, s := range stamps {
+		if c.stamps[name] != s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Certificates) stat() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	names := []string{c.config.CertFile, c.config.KeyFile, c.config.ServerCAFile, c.config.ClientCAFile}
+	for _, hc := range c.config.Hosts {
+		names = append(names, hc.CertFile, hc.KeyFile, hc.ClientCAFile)
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		stamps[name] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stamps
+}
+
+// ServerName returns the server name the DTLS client requested with SNI. It is
+// available once the handshake is complete.
+func (c *Certificates) ServerName(state *dtls.State) string {
+	if c == nil || state == nil {
+		return ""
+	}
+	c.snisMu.Lock()
+	defer c.snisMu.Unlock()
+	return c.snis[state.RemoteRandomBytes()].name
+}
+
+// RequestsClientCert reports whether the policy of the server name the DTLS client requested
+// asks for the client certificate. DTLS handshake always requests the certificate, so the one
+// sent for the server name that doesn't ask for it is not checked, and it must be ignored.
+func (c *Certificates) RequestsClientCert(state *dtls.State) bool {
+	if c == nil || state == nil {
+		return false
+	}
+	return c.current().lookup(c.ServerName(state)).auth != NoClientCert
+}
+
+// configForClient returns tls.Config.GetConfigForClient that uses the current certificates
+// of the requested server name. Configurations are cloned from the base one once per reload.
+func (c *Certificates) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	type cached struct {
+		material *material
+		configs  sync.Map
+	}
+	var cache atomic.Pointer[cached]
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		m := c.current()
+		cc := cache.Load()
+		if cc == nil || cc.material != m {
+			cc = &cached{material: m}
+			cache.Store(cc)
+		}
+		h := m.lookup(hello.ServerName)
+		if config, ok := cc.configs.Load(h); ok {
+			return config.(*tls.Config), nil
+		}
+		config, _ := cc.configs.LoadOrStore(h, h.tlsConfig(base, m.rootCAs, c.config.Validator))
+		return config.(*tls.Config), nil
+	}
+}
+
+// getCertificate is dtls.Config.GetCertificate that returns the current certificate of the
+// requested server name. The name is kept for the connection verification and the session.
+func (c *Certificates) getCertificate(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now()
+	c.snisMu.Lock()
+	for r, s := range c.snis {
+		if now.Sub(s.at) > sniTTL {
+			delete(c.snis, r)
+		}
+	}
+	c.snis[hello.RandomBytes] = sni{name: hello.ServerName, at: now}
+	c.snisMu.Unlock()
+	return c.current().lookup(hello.ServerName).cert, nil
+}
+
+// verifyConnection returns dtls.Config.VerifyConnection that applies the client authentication
+// policy of the requested server name, since DTLS configuration can't be changed per handshake.
+func (c *Certificates) verifyConnection(validator verifier.Validator) func(*dtls.State) error {
+	return func(state *dtls.State) error {
+		h := c.current().lookup(c.ServerName(state))
+		rawCerts := state.PeerCertificates
+		if len(rawCerts) == 0 {
+			if h.auth.requires() {
+				return errNoClientCert
+			}
+			return nil
+		}
+		if !h.auth.verifies() {
+			return nil
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{
+			Roots:         h.clientCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := certs[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		if validator != nil {
+			return validator(rawCerts, chains)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// ClientAuth is the client authentication mode.
+type ClientAuth int
+
+const (
+	// DefaultClientAuth requires and verifies the client certificate if the client CA
+	// file is set, and does not request the certificate otherwise.
+	DefaultClientAuth ClientAuth = iota
+	NoClientCert
+	RequestClientCert
+	RequireAnyClientCert
+	VerifyClientCertIfGiven
+	RequireAndVerifyClientCert
+)
+
+var errClientAuth = "unknown client auth mode %q"
+
+// HostConfig is the TLS configuration used for the clients requesting the server name with SNI.
+// Files that are not set are taken from the listener configuration.
+type HostConfig struct {
+	// ServerName is the host name, or the wildcard name such as "*.example.com".
+	ServerName   string     `env:"SERVER_NAME"    envDefault:""`
+	CertFile     string     `env:"CERT_FILE"      envDefault:""`
+	KeyFile      string     `env:"KEY_FILE"       envDefault:""`
+	ClientCAFile string     `env:"CLIENT_CA_FILE" envDefault:""`
+	ClientAuth   ClientAuth `env:"CLIENT_AUTH"    envDefault:""`
+}
+
+// host is the certificate and the client authentication policy of the server name.
+type host struct {
+	name      string
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	auth      ClientAuth
+}
+
+func newHost(name string, cert *tls.Certificate, clientCAs *x509.CertPool, auth ClientAuth) *host {
+	if auth == DefaultClientAuth {
+		auth = NoClientCert
+		if clientCAs != nil {
+			auth = RequireAndVerifyClientCert
+		}
+	}
+	return &host{
+		name:      strings.ToLower(name),
+		cert:      cert,
+		clientCAs: clientCAs,
+		auth:      auth,
+	}
+}
+
+// lookup returns the host matching the server name, or the default one. Exact
+// names take precedence over the wildcard ones, which match a single label.
+func (m *material) lookup(serverName string) *host {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return m.def
+	}
+	for _, h := range m.hosts {
+		if h.name == name {
+			return h
+		}
+	}
+	if _, domain, ok := strings.Cut(name, "."); ok {
+		for _, h := range m.hosts {
+			if h.name == "*."+domain {
+				return h
+			}
+		}
+	}
+	return m.def
+}
+
+func (h *host) tlsConfig(base *tls.Config, rootCAs *x509.CertPool, validator func([][]byte, [][]*x509.Certificate) error) *tls.Config {
+	config := base.Clone()
+	config.Certificates = []tls.Certificate{*h.cert}
+	config.RootCAs = rootCAs
+	config.ClientCAs = h.clientCAs
+	config.ClientAuth = h.auth.tls()
+	config.VerifyPeerCertificate = nil
+	if h.auth.verifies() && validator != nil {
+		config.VerifyPeerCertificate = validator
+	}
+	return config
+}
+
+// requires reports if the client must send the certificate.
+func (ca ClientAuth) requires() bool {
+	return ca == RequireAnyClientCert || ca == RequireAndVerifyClientCert
+}
+
+// verifies reports if the client certificate is verified against the client CA pool.
+func (ca ClientAuth) verifies() bool {
+	return ca == VerifyClientCertIfGiven || ca == RequireAndVerifyClientCert
+}
+
+func (ca ClientAuth) tls() tls.ClientAuthType {
+	switch ca {
+	case RequestClientCert:
+		return tls.RequestClientCert
+	case RequireAnyClientCert:
+		return tls.RequireAnyClientCert
+	case VerifyClientCertIfGiven:
+		return tls.VerifyClientCertIfGiven
+	case RequireAndVerifyClientCert:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+func (ca ClientAuth) String() string {
+	switch ca {
+	case NoClientCert:
+		return "none"
+	case RequestClientCert:
+		return "request"
+	case RequireAnyClientCert:
+		return "require_any"
+	case VerifyClientCertIfGiven:
+		return "verify_if_given"
+	case RequireAndVerifyClientCert:
+		return "require_and_verify"
+	default:
+		return "default"
+	}
+}
+
+// UnmarshalText parses the client auth mode, such as "require_and_verify".
+func (ca *ClientAuth) UnmarshalText(text []byte) error {
+	switch s := strings.ToLower(strings.TrimSpace(string(text))); s {
+	case "", "default":
+		*ca = DefaultClientAuth
+	case "none":
+		*ca = NoClientCert
+	case "request":
+		*ca = RequestClientCert
+	case "require_any":
+		*ca = RequireAnyClientCert
+	case "verify_if_given":
+		*ca = VerifyClientCertIfGiven
+	case "require_and_verify":
+		*ca = RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf(errClientAuth, s)
+	}
+	return nil
+}
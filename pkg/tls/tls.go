@@ -27,78 +27,41 @@ type TLSConfig interface {
 }
 
 // LoadTLSConfig returns a TLS or DTLS configuration that can be used for TLS or DTLS servers.
+// The certificates are loaded once per Config, and the returned configuration uses the current
+// ones for each new connection, so they can be reloaded with Certificates.Watch.
 func LoadTLSConfig[sc TLSConfig](c *Config, s sc) (sc, error) {
 	if c.CertFile == "" || c.KeyFile == "" {
 		return nil, nil
 	}
 
-	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
-	if err != nil {
-		return nil, errors.Join(errLoadCerts, err)
-	}
-
-	// Loading Server CA file
-	rootCA, err := loadCertFile(c.ServerCAFile)
-	if err != nil {
-		return nil, errors.Join(errLoadServerCA, err)
-	}
-
-	// Loading Client CA File
-	clientCA, err := loadCertFile(c.ClientCAFile)
-	if err != nil {
-		return nil, errors.Join(errLoadClientCA, err)
+	if c.certs == nil {
+		certs, err := LoadCertificates(c)
+		if err != nil {
+			return nil, err
+		}
+		c.certs = certs
 	}
+	m := c.certs.current()
 
 	switch config := any(s).(type) {
 	case *tls.Config:
-		config.Certificates = []tls.Certificate{certificate}
-
-		if len(rootCA) > 0 {
-			if config.RootCAs == nil {
-				config.RootCAs = x509.NewCertPool()
-			}
-			if !config.RootCAs.AppendCertsFromPEM(rootCA) {
-				return nil, errAppendCA
-			}
-		}
-
-		if len(clientCA) > 0 {
-			if config.ClientCAs == nil {
-				config.ClientCAs = x509.NewCertPool()
-			}
-			if !config.ClientCAs.AppendCertsFromPEM(clientCA) {
-				return nil, errAppendCA
-			}
-			config.ClientAuth = tls.RequireAndVerifyClientCert
-			if c.Validator != nil {
-				config.VerifyPeerCertificate = c.Validator
-			}
+		config.Certificates = []tls.Certificate{*m.def.cert}
+		config.RootCAs = m.rootCAs
+		config.ClientCAs = m.def.clientCAs
+		config.ClientAuth = m.def.auth.tls()
+		if m.def.auth.verifies() && c.Validator != nil {
+			config.VerifyPeerCertificate = c.Validator
 		}
+		config.GetConfigForClient = c.certs.configForClient(config.Clone())
 		return s, nil
 	case *dtls.Config:
-		config.Certificates = []tls.Certificate{certificate}
-
-		if len(rootCA) > 0 {
-			if config.RootCAs == nil {
-				config.RootCAs = x509.NewCertPool()
-			}
-			if !config.RootCAs.AppendCertsFromPEM(rootCA) {
-				return nil, errAppendCA
-			}
-		}
-
-		if len(clientCA) > 0 {
-			if config.ClientCAs == nil {
-				config.ClientCAs = x509.NewCertPool()
-			}
-			if !config.ClientCAs.AppendCertsFromPEM(clientCA) {
-				return nil, errAppendCA
-			}
-			config.ClientAuth = dtls.RequireAndVerifyClientCert
-			if c.Validator != nil {
-				config.VerifyPeerCertificate = c.Validator
-			}
-		}
+		config.GetCertificate = c.certs.getCertificate
+		config.RootCAs = m.rootCAs
+		// The client certificate is always requested and checked against the policy of
+		// the requested server name by VerifyConnection, since the handshake can't be
+		// configured per server name, and the policy may change when the files are reloaded.
+		config.ClientAuth = dtls.RequestClientCert
+		config.VerifyConnection = c.certs.verifyConnection(c.Validator)
 		return s, nil
 	default:
 		return nil, errUnsupportedTLS
@@ -126,6 +89,22 @@ func ClientCert(conn net.Conn) (x509.Certificate, error) {
 	}
 }
 
+// Verified reports whether the client certificate of the TLS connection was verified
+// against the client CA pool. The connections wrapping the TLS connection are unwrapped.
+func Verified(conn net.Conn) bool {
+	for conn != nil {
+		if c, ok := conn.(*tls.Conn); ok {
+			return len(c.ConnectionState().VerifiedChains) > 0
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = u.NetConn()
+	}
+	return false
+}
+
 // SecurityStatus returns log message from TLS config.
 func SecurityStatus[sc TLSConfig](s sc) string {
 	if s == nil {
@@ -14,10 +14,14 @@ import (
 	"os"
 	"time"
 
+	"github.com/absmach/mgate/pkg/metrics"
 	"github.com/absmach/mgate/pkg/tls/verifier"
 	"github.com/caarlos0/env/v11"
 )
 
+// method is the verification method reported in the metrics.
+const method = "crl"
+
 var (
 	errRetrieveCRL         = errors.New("failed to retrieve CRL")
 	errReadCRL             = errors.New("failed to read CRL")
@@ -57,6 +61,12 @@ func New(opts env.Options) (verifier.Verifier, error) {
 }
 
 func (c *config) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	err := c.verify(rawCerts, verifiedChains)
+	metrics.CertVerified(method, outcome(err))
+	return err
+}
+
+func (c *config) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	switch {
 	case len(verifiedChains) > 0:
 		return c.VerifyVerifiedPeerCertificates(verifiedChains)
@@ -281,3 +291,15 @@ func parseCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
 	}
 	return certs, nil
 }
+
+// outcome returns the verification outcome reported in the metrics.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return metrics.Valid
+	case errors.Is(err, errCertRevoked):
+		return metrics.Revoked
+	default:
+		return metrics.Failed
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing traces the connections and the messages proxied by mGate with OpenTelemetry.
+//
+// Each connection has its own trace with the spans of the TLS handshake and the connection
+// hooks. Each message starts a new trace, or continues the trace propagated in the message,
+// and it is linked to the connection span, so the connection traces are not infinitely long.
+// Spans are recorded with the global tracer provider, which can be set up with Init.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/caarlos0/env/v11"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/absmach/mgate"
+
+// Names of the spans.
+const (
+	Connection    = "connection"
+	Handshake     = "tls_handshake"
+	Dial          = "dial"
+	PreIntercept  = "pre_intercept"
+	PostIntercept = "post_intercept"
+	Write         = "write"
+)
+
+// Attributes of the spans.
+const (
+	ProtocolKey  = attribute.Key("mgate.protocol")
+	DirectionKey = attribute.Key("mgate.direction")
+	ClientIDKey  = attribute.Key("mgate.client_id")
+	TopicKey     = attribute.Key("mgate.topic")
+)
+
+// propagator propagates the trace context in the W3C traceparent and tracestate fields.
+var propagator = propagation.TraceContext{}
+
+// Config is the configuration of the trace exporter.
+type Config struct {
+	// URL is the OTLP/HTTP traces endpoint, such as http://localhost:4318/v1/traces.
+	// Traces are not exported if it's empty, but the trace context is still propagated.
+	URL         string  `env:"URL"          envDefault:""`
+	ServiceName string  `env:"SERVICE_NAME" envDefault:"mgate"`
+	SampleRatio float64 `env:"SAMPLE_RATIO" envDefault:"1"`
+}
+
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Init sets the global tracer provider that exports the traces to the OTLP endpoint,
+// and returns the function that flushes the remaining spans and stops the exporter.
+// The global tracer provider is not changed if the endpoint is not set.
+func Init(ctx context.Context, c Config) (func(context.Context) error, error) {
+	if c.URL == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(c.URL))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(c.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// StartConnection starts the span of the client connection with the remote address.
+func StartConnection(ctx context.Context, protocol string, remote net.Addr) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{ProtocolKey.String(protocol)}
+	if remote != nil {
+		attrs = append(attrs, semconv.ClientAddress(remote.String()))
+	}
+	return Start(ctx, Connection, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// Start starts the span with the given name as a child of the span in the context.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// StartMessage starts the span of the message received on the connection with the span in the context.
+// The message span continues the trace propagated in the carrier, if any, or it starts a new trace.
+// Either way, it is linked to the connection span. The carrier can be nil.
+func StartMessage(ctx context.Context, name string, carrier propagation.TextMapCarrier, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	conn := trace.SpanContextFromContext(ctx)
+	if conn.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: conn}))
+	}
+	if carrier != nil {
+		mctx := propagator.Extract(ctx, carrier)
+		if sc := trace.SpanContextFromContext(mctx); sc.IsValid() && !sc.Equal(conn) {
+			return Start(mctx, name, opts...)
+		}
+	}
+	return Start(ctx, name, append(opts, trace.WithNewRoot())...)
+}
+
+// End ends the span, and marks it failed if the error is not nil. End of stream is not a failure.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, io.EOF) {
+		Fail(span, err)
+	}
+	span.End()
+}
+
+// Fail marks the span failed with the error.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// DialFunc connects to the address on the named network.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WrapDial returns the dial function that connects to the upstream server in the dial span.
+func WrapDial(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, span := Start(ctx, Dial, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.ServerAddress(addr)))
+		conn, err := dial(ctx, network, addr)
+		End(span, err)
+		return conn, err
+	}
+}
+
+// Extract returns the context with the remote span propagated in the carrier, if any.
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
+
+// Inject propagates the span in the context to the carrier, replacing the propagated one.
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	propagator.Inject(ctx, carrier)
+}
+
+// Fields returns the keys the trace context is propagated in.
+func Fields() []string {
+	return propagator.Fields()
+}
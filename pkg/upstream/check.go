@@ -0,0 +1,94 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+
+	mqttv3 "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/google/uuid"
+)
+
+const probeClientPrefix = "mgate-health-"
+
+const (
+	coapVersion     = 1
+	coapAck         = 2
+	coapReset       = 3
+	coapMaxResponse = 1280
+)
+
+// probe checks if the target is healthy. The target is dialed the same way as for
+// the client connections, so the check covers the TLS handshake with the target.
+func probe(ctx context.Context, check Check, dial DialFunc, addr string) error {
+	c, err := dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if check == TCPCheck {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	if check == CoAPCheck {
+		return probeCoAP(c)
+	}
+	return probeMQTT(c)
+}
+
+// probeMQTT sends MQTT 3.1.1 CONNECT and waits for CONNACK. The target is healthy
+// if it responds with any CONNACK, since the probe is not expected to be authorized.
+func probeMQTT(c net.Conn) error {
+	connect := mqttv3.NewControlPacket(mqttv3.Connect).(*mqttv3.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = probeClientPrefix + uuid.NewString()
+	if err := connect.Write(c); err != nil {
+		return err
+	}
+	pkt, err := mqttv3.ReadPacket(c)
+	if err != nil {
+		return err
+	}
+	if _, ok := pkt.(*mqttv3.ConnackPacket); !ok {
+		return fmt.Errorf("unexpected response to CONNECT: %s", pkt.String())
+	}
+	// The connection is closed right away, so the error is not important.
+	_ = mqttv3.NewControlPacket(mqttv3.Disconnect).Write(c)
+	return nil
+}
+
+// probeCoAP sends CoAP ping, which is an empty confirmable message, and waits for
+// the reset or the acknowledgement with the same message ID.
+func probeCoAP(c net.Conn) error {
+	id := uint16(rand.Uint32())
+	ping := []byte{coapVersion << 6, 0, byte(id >> 8), byte(id)}
+	if _, err := c.Write(ping); err != nil {
+		return err
+	}
+	buf := make([]byte, coapMaxResponse)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n < len(ping) || buf[0]>>6 != coapVersion || binary.BigEndian.Uint16(buf[2:4]) != id {
+			// Datagrams may come late, such as the response to the previous ping.
+			continue
+		}
+		if typ := buf[0] >> 4 & 0x3; typ != coapReset && typ != coapAck {
+			return fmt.Errorf("unexpected response to CoAP ping of type %d", typ)
+		}
+		return nil
+	}
+}
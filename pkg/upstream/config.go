@@ -0,0 +1,197 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Strategy defines how the target is selected for the new connection.
+type Strategy int
+
+const (
+	// RoundRobin selects the targets in turn.
+	RoundRobin Strategy = iota
+	// LeastConnections selects the target with the fewest open connections.
+	LeastConnections
+	// Random selects a random target.
+	Random
+	// ConsistentHash selects the target by the client key on a consistent hash ring,
+	// so all the connections of the client land on the same target.
+	ConsistentHash
+)
+
+// HashKey defines which client attribute is used by ConsistentHash strategy.
+type HashKey int
+
+const (
+	// ClientIDKey routes the clients by client ID.
+	ClientIDKey HashKey = iota
+	// UsernameKey routes the clients by username.
+	UsernameKey
+)
+
+// Check defines how the targets are actively health checked.
+type Check int
+
+const (
+	// NoCheck disables active health checks.
+	NoCheck Check = iota
+	// TCPCheck checks if a TCP connection to the target can be opened.
+	TCPCheck
+	// MQTTCheck checks if the target responds to MQTT CONNECT with CONNACK.
+	MQTTCheck
+	// CoAPCheck checks if the target responds to CoAP ping. It is the only check of CoAP targets.
+	CoAPCheck
+)
+
+var (
+	errStrategy = "unknown upstream strategy %q"
+	errCheck    = "unknown upstream health check %q"
+	errNetwork  = "upstream health check %q is not supported for %s targets"
+	errProxy    = "unsupported upstream PROXY protocol version %d"
+	errDuration = "invalid upstream %s %s"
+	errHashKey  = "unknown upstream hash key %q"
+)
+
+// Config is the upstream pool configuration.
+type Config struct {
+	// Targets are the addresses of the upstream servers in host:port format.
+	// If empty, the pool consists of the single target from the proxy configuration.
+	Targets  []string `env:"TARGETS"               envDefault:""`
+	Strategy Strategy `env:"STRATEGY"              envDefault:"round_robin"`
+	HashKey  HashKey  `env:"HASH_KEY"              envDefault:"client_id"`
+	// HealthCheck is the active health check of the targets.
+	HealthCheck   Check         `env:"HEALTH_CHECK"          envDefault:"none"`
+	CheckInterval time.Duration `env:"HEALTH_CHECK_INTERVAL" envDefault:"10s"`
+	CheckTimeout  time.Duration `env:"HEALTH_CHECK_TIMEOUT"  envDefault:"5s"`
+	// MaxFails is the number of consecutive connection failures after which the target
+	// is ejected from the pool for FailTimeout. Zero disables passive ejection.
+	MaxFails    int           `env:"MAX_FAILS"             envDefault:"3"`
+	FailTimeout time.Duration `env:"FAIL_TIMEOUT"          envDefault:"30s"`
+	// ProxyProtocol is the version of PROXY protocol header, 1 or 2, sent to the targets
+	// with the original client address. Zero disables the header.
+	ProxyProtocol int `env:"PROXY_PROTOCOL"        envDefault:"0"`
+}
+
+func (s Strategy) String() string {
+	switch s {
+	case LeastConnections:
+		return "least_connections"
+	case Random:
+		return "random"
+	case ConsistentHash:
+		return "consistent_hash"
+	default:
+		return "round_robin"
+	}
+}
+
+// UnmarshalText parses strategy from its string representation,
+// so it can be loaded from environment variables.
+func (s *Strategy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "round_robin":
+		*s = RoundRobin
+	case "least_connections":
+		*s = LeastConnections
+	case "random":
+		*s = Random
+	case "consistent_hash":
+		*s = ConsistentHash
+	default:
+		return fmt.Errorf(errStrategy, text)
+	}
+	return nil
+}
+
+func (k HashKey) String() string {
+	if k == UsernameKey {
+		return "username"
+	}
+	return "client_id"
+}
+
+// UnmarshalText parses hash key from its string representation,
+// so it can be loaded from environment variables.
+func (k *HashKey) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "client_id":
+		*k = ClientIDKey
+	case "username":
+		*k = UsernameKey
+	default:
+		return fmt.Errorf(errHashKey, text)
+	}
+	return nil
+}
+
+func (c Check) String() string {
+	switch c {
+	case TCPCheck:
+		return "tcp"
+	case MQTTCheck:
+		return "mqtt"
+	case CoAPCheck:
+		return "coap"
+	default:
+		return "none"
+	}
+}
+
+// UnmarshalText parses health check from its string representation,
+// so it can be loaded from environment variables.
+func (c *Check) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "none":
+		*c = NoCheck
+	case "tcp":
+		*c = TCPCheck
+	case "mqtt":
+		*c = MQTTCheck
+	case "coap":
+		*c = CoAPCheck
+	default:
+		return fmt.Errorf(errCheck, text)
+	}
+	return nil
+}
+
+// Validate returns an error if the configuration is not valid.
+func (c Config) Validate() error {
+	if c.ProxyProtocol < 0 || c.ProxyProtocol > 2 {
+		return fmt.Errorf(errProxy, c.ProxyProtocol)
+	}
+	// The checks would fail right away without the timeout.
+	if c.HealthCheck != NoCheck && c.CheckTimeout <= 0 {
+		return fmt.Errorf(errDuration, "health check timeout", c.CheckTimeout)
+	}
+	if c.CheckInterval < 0 {
+		return fmt.Errorf(errDuration, "health check interval", c.CheckInterval)
+	}
+	if c.FailTimeout < 0 {
+		return fmt.Errorf(errDuration, "fail timeout", c.FailTimeout)
+	}
+	return nil
+}
+
+// ValidateCheck returns an error if the health check can't be used for the targets
+// listening on the given network, "tcp" or "udp".
+func (c Config) ValidateCheck(network string) error {
+	switch c.HealthCheck {
+	case NoCheck:
+		return nil
+	case CoAPCheck:
+		if network == "udp" {
+			return nil
+		}
+	default:
+		if network == "tcp" {
+			return nil
+		}
+	}
+	return fmt.Errorf(errNetwork, c.HealthCheck, network)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// replicas is the number of points of each target on the ring, which
+// spreads the keys evenly between the targets.
+const replicas = 160
+
+type point struct {
+	hash   uint32
+	target *Target
+}
+
+// ring is a consistent hash ring. Adding or removing a target remaps only
+// the keys of the ring segments owned by that target.
+type ring []point
+
+func newRing(targets []*Target) ring {
+	r := make(ring, 0, len(targets)*replicas)
+	for _, t := range targets {
+		for i := range replicas {
+			r = append(r, point{hash: hash(t.addr + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].hash < r[j].hash
+	})
+	return r
+}
+
+// lookup returns the owner of the key among the given targets. Keys owned by the
+// other targets move to the next target clockwise, and the rest stay in place.
+func (r ring) lookup(key string, targets []*Target) *Target {
+	h := hash(key)
+	start := sort.Search(len(r), func(i int) bool {
+		return r[i].hash >= h
+	})
+	for i := range r {
+		p := r[(start+i)%len(r)]
+		if slices.Contains(targets, p.target) {
+			return p.target
+		}
+	}
+	return targets[0]
+}
+
+// hash is FNV-1a followed by the MurmurHash3 finalizer. FNV-1a alone clusters
+// the points of the strings that differ only in the last characters.
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,275 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstream provides a pool of upstream servers with health checking and load balancing.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoTargets indicates the pool has no targets to connect to.
+var ErrNoTargets = errors.New("no upstream targets")
+
+// DialFunc opens a connection to the target with the given address.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// Target is a single upstream server in the pool.
+type Target struct {
+	addr        string
+	maxFails    int
+	failTimeout time.Duration
+	active      atomic.Int64
+
+	mu      sync.Mutex
+	healthy bool
+	fails   int
+	ejected time.Time
+}
+
+// Addr returns the target address in host:port format.
+func (t *Target) Addr() string {
+	return t.addr
+}
+
+// Connections returns the number of open connections to the target.
+func (t *Target) Connections() int64 {
+	return t.active.Load()
+}
+
+// Release releases the connection acquired from the pool.
+func (t *Target) Release() {
+	t.active.Add(-1)
+}
+
+// Report reports the result of the connection attempt to the target. The target is
+// ejected from the pool after the configured number of consecutive failures.
+func (t *Target) Report(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		t.fails = 0
+		return
+	}
+	t.fails++
+	if t.maxFails > 0 && t.fails >= t.maxFails {
+		t.ejected = time.Now().Add(t.failTimeout)
+		t.fails = 0
+	}
+}
+
+func (t *Target) available(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.healthy && now.After(t.ejected)
+}
+
+// setHealthy sets the result of the active health check and reports whether it changed.
+func (t *Target) setHealthy(healthy bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := t.healthy != healthy
+	t.healthy = healthy
+	return changed
+}
+
+// Pool selects the upstream targets for the new connections. It is safe for concurrent use.
+type Pool struct {
+	config  Config
+	targets []*Target
+	ring    ring
+	next    atomic.Uint64
+	logger  *slog.Logger
+}
+
+// New returns a new pool of the configured targets. If no targets are configured,
+// the pool consists of the given fallback target.
+func New(config Config, fallback string, logger *slog.Logger) *Pool {
+	addrs := config.Targets
+	if len(addrs) == 0 {
+		addrs = []string{fallback}
+	}
+	p := &Pool{
+		config: config,
+		logger: logger,
+	}
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		p.targets = append(p.targets, &Target{
+			addr:        addr,
+			maxFails:    config.MaxFails,
+			failTimeout: config.FailTimeout,
+			healthy:     true,
+		})
+	}
+	p.ring = newRing(p.targets)
+	return p
+}
+
+// Targets returns all the targets in the pool.
+func (p *Pool) Targets() []*Target {
+	return p.targets
+}
+
+// Key returns the key of the client used by ConsistentHash strategy.
+// It returns an empty string if the configured client attribute is not known.
+func (p *Pool) Key(clientID, username string) string {
+	if p.config.HashKey == UsernameKey {
+		return username
+	}
+	return clientID
+}
+
+// Acquire selects the target for the new connection of the client with the given key
+// and counts the connection until it is released. The key is used only by ConsistentHash
+// strategy, and the connections without the key are distributed in turn. If none of
+// the targets is available, it selects from all the targets, so the connections are
+// not refused when the checks are wrong.
+func (p *Pool) Acquire(key string) (*Target, error) {
+	return p.acquire(key, nil)
+}
+
+func (p *Pool) acquire(key string, tried []*Target) (*Target, error) {
+	if len(p.targets) == 0 {
+		return nil, ErrNoTargets
+	}
+	now := time.Now()
+	candidates := func(check bool) []*Target {
+		ret := make([]*Target, 0, len(p.targets))
+		for _, t := range p.targets {
+			if !slices.Contains(tried, t) && (!check || t.available(now)) {
+				ret = append(ret, t)
+			}
+		}
+		return ret
+	}
+	targets := candidates(true)
+	if len(targets) == 0 {
+		targets = candidates(false)
+	}
+	if len(targets) == 0 {
+		targets = p.targets
+	}
+	var t *Target
+	switch {
+	case p.config.Strategy == ConsistentHash && key != "":
+		t = p.ring.lookup(key, targets)
+	default:
+		t = p.selectTarget(targets)
+	}
+	t.active.Add(1)
+	return t, nil
+}
+
+// Dial opens the connection for the client with the given key to the target selected
+// from the pool. If the connection fails, the other targets are tried. The target is
+// released once the connection is closed.
+func (p *Pool) Dial(ctx context.Context, key string, dial DialFunc) (net.Conn, error) {
+	var errs []error
+	tried := make([]*Target, 0, len(p.targets))
+	for range p.targets {
+		t, err := p.acquire(key, tried)
+		if err != nil {
+			return nil, err
+		}
+		tried = append(tried, t)
+		c, err := dial(ctx, t.addr)
+		t.Report(err)
+		if err != nil {
+			t.Release()
+			p.logger.Warn("Failed to connect to upstream", slog.String("target", t.addr), slog.Any("error", err))
+			errs = append(errs, err)
+			continue
+		}
+		return &conn{Conn: c, target: t}, nil
+	}
+	if len(errs) == 0 {
+		return nil, ErrNoTargets
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Run runs the active health checks until the context is canceled.
+// The targets are checked over the connections opened with the given dial function.
+func (p *Pool) Run(ctx context.Context, dial DialFunc) {
+	if p.config.HealthCheck == NoCheck || p.config.CheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, t := range p.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.check(ctx, dial, t)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) check(ctx context.Context, dial DialFunc, t *Target) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.CheckTimeout)
+	defer cancel()
+	err := probe(ctx, p.config.HealthCheck, dial, t.addr)
+	if !t.setHealthy(err == nil) {
+		return
+	}
+	if err != nil {
+		p.logger.Warn("Upstream target is unhealthy", slog.String("target", t.addr), slog.Any("error", err))
+		return
+	}
+	p.logger.Info("Upstream target is healthy", slog.String("target", t.addr))
+}
+
+func (p *Pool) selectTarget(targets []*Target) *Target {
+	switch p.config.Strategy {
+	case LeastConnections:
+		// Start from the next target, so the targets with
+		// the same number of connections are selected in turn.
+		start := int(p.next.Add(1) % uint64(len(targets)))
+		selected := targets[start]
+		for i := 1; i < len(targets); i++ {
+			t := targets[(start+i)%len(targets)]
+			if t.active.Load() < selected.active.Load() {
+				selected = t
+			}
+		}
+		return selected
+	case Random:
+		return targets[rand.IntN(len(targets))]
+	default:
+		// ConsistentHash distributes the connections without the key in turn.
+		return targets[(p.next.Add(1)-1)%uint64(len(targets))]
+	}
+}
+
+// conn releases the target when closed.
+type conn struct {
+	net.Conn
+	target *Target
+	once   sync.Once
+}
+
+func (c *conn) Close() error {
+	c.once.Do(c.target.Release)
+	return c.Conn.Close()
+}
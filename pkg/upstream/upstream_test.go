@@ -0,0 +1,245 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	logger     = slog.New(slog.NewTextHandler(io.Discard, nil))
+	errRefused = errors.New("connection refused")
+)
+
+func addrs(n int) []string {
+	ret := make([]string, n)
+	for i := range ret {
+		ret[i] = "10.0.0." + strconv.Itoa(i+1) + ":1883"
+	}
+	return ret
+}
+
+func TestRing(t *testing.T) {
+	const keys = 10000
+	cases := []struct {
+		desc    string
+		targets int
+	}{
+		{desc: "two targets", targets: 2},
+		{desc: "three targets", targets: 3},
+		{desc: "ten targets", targets: 10},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := New(Config{Targets: addrs(tc.targets), Strategy: ConsistentHash}, "", logger)
+			targets := p.Targets()
+
+			owners := make(map[string]*Target, keys)
+			counts := make(map[*Target]int)
+			for i := range keys {
+				key := "client-" + strconv.Itoa(i)
+				owner := p.ring.lookup(key, targets)
+				owners[key] = owner
+				counts[owner]++
+			}
+			mean := keys / tc.targets
+			for _, tg := range targets {
+				if n := counts[tg]; n < mean/2 || n > mean*3/2 {
+					t.Errorf("expected about %d keys on %s, got %d", mean, tg.Addr(), n)
+				}
+			}
+
+			// Only the keys of the removed target move, and they move to the other targets.
+			removed := targets[0]
+			rest := targets[1:]
+			for key, owner := range owners {
+				got := p.ring.lookup(key, rest)
+				switch {
+				case owner != removed && got != owner:
+					t.Fatalf("expected key %s to stay on %s, got %s", key, owner.Addr(), got.Addr())
+				case owner == removed && !slices.Contains(rest, got):
+					t.Fatalf("expected key %s to move to the remaining targets, got %s", key, got.Addr())
+				}
+			}
+		})
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	cases := []struct {
+		desc     string
+		strategy Strategy
+		active   []int64
+		want     []int
+	}{
+		{desc: "round robin", strategy: RoundRobin, active: []int64{0, 0, 0}, want: []int{0, 1, 2, 0}},
+		{desc: "least connections", strategy: LeastConnections, active: []int64{5, 1, 3}, want: []int{1, 1}},
+		{desc: "consistent hash without key", strategy: ConsistentHash, active: []int64{0, 0}, want: []int{0, 1, 0}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := New(Config{Targets: addrs(len(tc.active)), Strategy: tc.strategy}, "", logger)
+			for i, n := range tc.active {
+				p.targets[i].active.Store(n)
+			}
+			for i, want := range tc.want {
+				got, err := p.Acquire("")
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				// Keep the counts fixed, so the least connections target stays the same.
+				got.Release()
+				if got != p.targets[want] {
+					t.Fatalf("expected target %d on attempt %d, got %s", want, i, got.Addr())
+				}
+			}
+		})
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	cases := []struct {
+		desc   string
+		failed []int
+		err    bool
+	}{
+		{desc: "first target up"},
+		{desc: "first target down", failed: []int{0}},
+		{desc: "two targets down", failed: []int{0, 1}},
+		{desc: "all targets down", failed: []int{0, 1, 2}, err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := New(Config{Targets: addrs(3)}, "", logger)
+			var dialed []string
+			dial := func(_ context.Context, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				for _, i := range tc.failed {
+					if p.targets[i].addr == addr {
+						return nil, errRefused
+					}
+				}
+				c, s := net.Pipe()
+				s.Close()
+				return c, nil
+			}
+			conn, err := p.Dial(context.Background(), "", dial)
+			if tc.err {
+				if !errors.Is(err, errRefused) {
+					t.Fatalf("expected %s, got %v", errRefused, err)
+				}
+				if len(dialed) != len(p.targets) {
+					t.Fatalf("expected all %d targets to be tried, got %v", len(p.targets), dialed)
+				}
+				for _, tg := range p.targets {
+					if n := tg.Connections(); n != 0 {
+						t.Fatalf("expected failed target %s to be released, got %d connections", tg.Addr(), n)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			// Only the failed targets are tried before the connection succeeds, each of them once.
+			if len(slices.Compact(slices.Sorted(slices.Values(dialed)))) != len(dialed) {
+				t.Fatalf("expected each target to be tried once, got %v", dialed)
+			}
+			for j, addr := range dialed {
+				i := slices.IndexFunc(p.targets, func(tg *Target) bool { return tg.addr == addr })
+				if down := slices.Contains(tc.failed, i); down != (j < len(dialed)-1) {
+					t.Fatalf("expected the connection to fail over to the first target that is up, got %v", dialed)
+				}
+			}
+			want := p.targets[slices.IndexFunc(p.targets, func(tg *Target) bool { return tg.addr == dialed[len(dialed)-1] })]
+			if n := want.Connections(); n != 1 {
+				t.Fatalf("expected 1 connection to %s, got %d", want.addr, n)
+			}
+			conn.Close()
+			if n := want.Connections(); n != 0 {
+				t.Fatalf("expected the target to be released on close, got %d connections", n)
+			}
+		})
+	}
+}
+
+func TestEjection(t *testing.T) {
+	const failTimeout = time.Minute
+	cases := []struct {
+		desc     string
+		maxFails int
+		fails    int
+		ejected  bool
+	}{
+		{desc: "below max fails", maxFails: 3, fails: 2},
+		{desc: "at max fails", maxFails: 3, fails: 3, ejected: true},
+		{desc: "passive ejection disabled", maxFails: 0, fails: 10},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := New(Config{Targets: addrs(2), MaxFails: tc.maxFails, FailTimeout: failTimeout}, "", logger)
+			tg := p.targets[0]
+			for range tc.fails {
+				tg.Report(errRefused)
+			}
+			now := time.Now()
+			if got := !tg.available(now); got != tc.ejected {
+				t.Fatalf("expected ejected %t, got %t", tc.ejected, got)
+			}
+			if tc.ejected {
+				for range 4 {
+					if got, _ := p.Acquire(""); got == tg {
+						t.Fatal("expected ejected target not to be selected")
+					}
+				}
+			}
+			// The target recovers once the fail timeout passes.
+			if !tg.available(now.Add(failTimeout + time.Second)) {
+				t.Fatal("expected target to be available after the fail timeout")
+			}
+		})
+	}
+}
+
+func TestEjectionReset(t *testing.T) {
+	p := New(Config{Targets: addrs(1), MaxFails: 2, FailTimeout: time.Minute}, "", logger)
+	tg := p.targets[0]
+	tg.Report(errRefused)
+	tg.Report(nil)
+	tg.Report(errRefused)
+	if !tg.available(time.Now()) {
+		t.Fatal("expected successful connection to reset the consecutive failures")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		desc   string
+		config Config
+		err    bool
+	}{
+		{desc: "defaults", config: Config{HealthCheck: TCPCheck, CheckInterval: time.Second, CheckTimeout: time.Second, FailTimeout: time.Second}},
+		{desc: "no check without timeout", config: Config{HealthCheck: NoCheck}},
+		{desc: "check without timeout", config: Config{HealthCheck: TCPCheck, CheckInterval: time.Second}, err: true},
+		{desc: "negative check timeout", config: Config{HealthCheck: MQTTCheck, CheckTimeout: -time.Second}, err: true},
+		{desc: "negative check interval", config: Config{CheckInterval: -time.Second}, err: true},
+		{desc: "negative fail timeout", config: Config{FailTimeout: -time.Second}, err: true},
+		{desc: "invalid PROXY protocol version", config: Config{ProxyProtocol: 3}, err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if err := tc.config.Validate(); (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+		})
+	}
+}